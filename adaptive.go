@@ -0,0 +1,214 @@
+package xhandler
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// LimitSample is the outcome of a request fed to a LimitAlgorithm.
+type LimitSample struct {
+	// RTT is the time spent serving the request, excluding queuing.
+	RTT time.Duration
+	// InFlight is the number of requests in flight when the request
+	// started, including itself.
+	InFlight int
+	// Dropped is true if the request timed out, a sign of overload.
+	Dropped bool
+}
+
+// LimitAlgorithm computes a new concurrency limit from the current one and
+// a request sample. Calls are serialized by the AdaptiveLimiter, so
+// implementations don't need to be safe for concurrent use.
+type LimitAlgorithm interface {
+	Update(limit int, s LimitSample) int
+}
+
+// AIMD is an additive increase, multiplicative decrease limit algorithm:
+// the limit grows by Increase for each successful request made while the
+// limit was used and is multiplied by Backoff when a request is dropped or
+// exceeds Timeout.
+type AIMD struct {
+	// Increase is added to the limit on success. Defaults to 1.
+	Increase int
+	// Backoff is the factor applied to the limit on drop. Defaults to 0.9.
+	Backoff float64
+	// Timeout, if set, makes slower requests count as dropped.
+	Timeout time.Duration
+}
+
+// Update implements LimitAlgorithm.
+func (a *AIMD) Update(limit int, s LimitSample) int {
+	if s.Dropped || a.Timeout > 0 && s.RTT > a.Timeout {
+		backoff := a.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = 0.9
+		}
+		return int(math.Floor(float64(limit) * backoff))
+	}
+	if s.InFlight*2 < limit {
+		// Application limited, the limit was not tested
+		return limit
+	}
+	inc := a.Increase
+	if inc <= 0 {
+		inc = 1
+	}
+	return limit + inc
+}
+
+// Gradient adjusts the limit based on the ratio between the no-load latency
+// and the latency of the last requests, like Netflix's gradient2
+// algorithm: when latency rises above the no-load latency times Tolerance,
+// requests are queuing and the limit is lowered.
+//
+// The no-load latency is a long term average of the samples which show no
+// sign of queuing: those within Tolerance of it or taken while the limit
+// was not reached. A lasting latency increase caused by something else than
+// load (e.g. a slower dependency) is thus only learned once the traffic
+// does not use the whole limit. Conversely, a drop while the latency looks
+// normal reveals a no-load latency learned under load, which is then reset.
+type Gradient struct {
+	// Tolerance is the latency increase ratio tolerated before lowering the
+	// limit. Defaults to 1.5.
+	Tolerance float64
+	// Smoothing is the weight of a new limit against the previous one.
+	// Defaults to 0.2.
+	Smoothing float64
+	// Window is the number of samples of the no-load latency average.
+	// Defaults to 600.
+	Window int
+
+	short, noLoad float64
+	limit         float64
+}
+
+// Update implements LimitAlgorithm.
+func (g *Gradient) Update(limit int, s LimitSample) int {
+	tolerance, smoothing, window := g.Tolerance, g.Smoothing, float64(g.Window)
+	if tolerance <= 1 {
+		tolerance = 1.5
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	if window <= 0 {
+		window = 600
+	}
+	if int(g.limit) != limit {
+		g.limit = float64(limit)
+	}
+	rtt := float64(s.RTT)
+	if g.noLoad == 0 {
+		g.short, g.noLoad = rtt, rtt
+	}
+	g.short = g.short*0.9 + rtt*0.1
+	appLimited := s.InFlight*2 < limit
+	if appLimited || rtt < tolerance*g.noLoad {
+		g.noLoad = g.noLoad*(1-1/window) + rtt/window
+	}
+	if g.noLoad/g.short > 2 {
+		// Latency dropped a lot, quickly recover from a stale average
+		g.noLoad *= 0.95
+	}
+	if s.Dropped && g.noLoad*tolerance > g.short {
+		// Requests time out while latency looks normal: the no-load
+		// latency was learned under load, start over from lower
+		g.noLoad = g.short / (2 * tolerance)
+	}
+	if appLimited && !s.Dropped {
+		return limit
+	}
+	gradient := math.Max(0.5, math.Min(1, tolerance*g.noLoad/g.short))
+	if s.Dropped {
+		gradient = 0.5
+	}
+	n := g.limit*gradient + math.Sqrt(g.limit)
+	g.limit = g.limit*(1-smoothing) + n*smoothing
+	return int(g.limit)
+}
+
+// AdaptiveOptions configures an AdaptiveLimiter.
+type AdaptiveOptions struct {
+	// ConcurrencyOptions configures the underlying limiter. Its Limit is
+	// the initial limit.
+	ConcurrencyOptions
+	// MinLimit and MaxLimit bound the limit. They default to 1 and 1000.
+	MinLimit int
+	MaxLimit int
+	// Algorithm computes the limit. Defaults to Gradient.
+	Algorithm LimitAlgorithm
+}
+
+// AdaptiveLimiter is a ConcurrencyLimiter whose limit is continuously
+// adjusted by a LimitAlgorithm from the observed latencies and timeouts.
+// Requests whose context deadline expired (for instance set by
+// TimeoutHandler) count as dropped.
+type AdaptiveLimiter struct {
+	*ConcurrencyLimiter
+	o AdaptiveOptions
+	// algoMu serializes the algorithm updates, it is not the mutex of the
+	// embedded ConcurrencyLimiter
+	algoMu  sync.Mutex
+	current *GaugeVec
+}
+
+// NewAdaptiveLimiter creates an adaptive concurrency limiter.
+func NewAdaptiveLimiter(o AdaptiveOptions) *AdaptiveLimiter {
+	if o.MinLimit <= 0 {
+		o.MinLimit = 1
+	}
+	if o.MaxLimit <= 0 {
+		o.MaxLimit = 1000
+	}
+	if o.Limit <= 0 {
+		o.Limit = o.MinLimit
+	}
+	if o.Algorithm == nil {
+		o.Algorithm = &Gradient{}
+	}
+	l := &AdaptiveLimiter{ConcurrencyLimiter: NewConcurrencyLimiter(o.ConcurrencyOptions), o: o}
+	if o.Registry != nil {
+		l.current = o.Registry.Gauge("concurrency_limiter_limit",
+			"Current concurrency limit.", "limiter")
+		l.current.With(o.Name).Set(float64(o.Limit))
+	}
+	return l
+}
+
+// Observe feeds a sample to the algorithm and applies the new limit.
+func (l *AdaptiveLimiter) Observe(s LimitSample) {
+	l.algoMu.Lock()
+	defer l.algoMu.Unlock()
+	n := l.o.Algorithm.Update(l.Limit(), s)
+	if n < l.o.MinLimit {
+		n = l.o.MinLimit
+	} else if n > l.o.MaxLimit {
+		n = l.o.MaxLimit
+	}
+	l.SetLimit(n)
+	if l.current != nil {
+		l.current.With(l.o.Name).Set(float64(n))
+	}
+}
+
+// Handler implements the middleware.
+func (l *AdaptiveLimiter) Handler(next HandlerC) HandlerC {
+	return l.ConcurrencyLimiter.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		key := ""
+		if l.o.Key != nil {
+			key = l.o.Key(ctx, r)
+		}
+		inflight, _ := l.Stats(key)
+		start := time.Now()
+		next.ServeHTTPC(ctx, w, r)
+		l.Observe(LimitSample{
+			RTT:      time.Since(start),
+			InFlight: inflight,
+			Dropped:  ctx.Err() == context.DeadlineExceeded,
+		})
+	}))
+}
@@ -0,0 +1,113 @@
+package xhandler
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simulation models a service which serves up to capacity concurrent
+// requests at baseRTT; beyond, requests queue and latency grows linearly.
+// Requests slower than timeout are dropped.
+type simulation struct {
+	capacity int
+	baseRTT  time.Duration
+	timeout  time.Duration
+	demand   int
+	rnd      *rand.Rand
+}
+
+// run feeds steps samples to l and returns the average limit and the ratio
+// of dropped requests over the last quarter of the run.
+func (s simulation) run(l *AdaptiveLimiter, steps int) (avg, dropRatio float64) {
+	var sum float64
+	var n, drops int
+	for i := 0; i < steps; i++ {
+		inflight := l.Limit()
+		if inflight > s.demand {
+			inflight = s.demand
+		}
+		rtt := s.baseRTT
+		if inflight > s.capacity {
+			rtt = s.baseRTT * time.Duration(inflight) / time.Duration(s.capacity)
+		}
+		// +/- 10% jitter
+		rtt += time.Duration((s.rnd.Float64() - 0.5) * 0.2 * float64(rtt))
+		dropped := rtt > s.timeout
+		l.Observe(LimitSample{RTT: rtt, InFlight: inflight, Dropped: dropped})
+		if i >= steps*3/4 {
+			sum += float64(l.Limit())
+			n++
+			if dropped {
+				drops++
+			}
+		}
+	}
+	return sum / float64(n), float64(drops) / float64(n)
+}
+
+func TestAdaptiveLimiterConvergence(t *testing.T) {
+	sim := simulation{
+		capacity: 50,
+		baseRTT:  10 * time.Millisecond,
+		timeout:  30 * time.Millisecond,
+		demand:   1000,
+	}
+	for name, alg := range map[string]LimitAlgorithm{
+		"gradient": &Gradient{},
+		"aimd":     &AIMD{Timeout: 15 * time.Millisecond},
+	} {
+		for _, initial := range []int{1, 500} {
+			sim.rnd = rand.New(rand.NewSource(1))
+			l := NewAdaptiveLimiter(AdaptiveOptions{
+				ConcurrencyOptions: ConcurrencyOptions{Limit: initial},
+				Algorithm:          alg,
+			})
+			avg, drops := sim.run(l, 20000)
+			t.Logf("%s from %d: converged to %.1f (capacity %d), %.1f%% dropped", name, initial, avg, sim.capacity, drops*100)
+			// The limit must settle above the capacity (not wasting it) but
+			// low enough for requests to stay (mostly) within the timeout
+			assert.True(t, avg >= float64(sim.capacity) && avg <= float64(sim.capacity)*3,
+				"%s starting at %d converged to %.1f", name, initial, avg)
+			assert.True(t, drops < 0.1, "%s starting at %d dropped %.1f%%", name, initial, drops*100)
+		}
+	}
+}
+
+func TestAdaptiveLimiterAppLimited(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveOptions{
+		ConcurrencyOptions: ConcurrencyOptions{Limit: 20},
+		Algorithm:          &AIMD{},
+	})
+	for i := 0; i < 100; i++ {
+		l.Observe(LimitSample{RTT: time.Millisecond, InFlight: 2})
+	}
+	assert.Equal(t, 20, l.Limit(), "limit does not grow when it is not reached")
+}
+
+func TestAdaptiveLimiterTimeouts(t *testing.T) {
+	reg := NewRegistry()
+	l := NewAdaptiveLimiter(AdaptiveOptions{
+		ConcurrencyOptions: ConcurrencyOptions{Name: "api", Limit: 10, Registry: reg},
+		MinLimit:           2,
+		Algorithm:          &AIMD{Backoff: 0.5},
+	})
+	c := Chain{}
+	c.UseC(TimeoutHandler(time.Millisecond))
+	c.UseC(l.Handler)
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		<-ctx.Done()
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, 5, l.Limit())
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, 2, l.Limit(), "limit is bounded by MinLimit")
+	assert.Equal(t, 2.0, reg.Gauge("concurrency_limiter_limit", "", "limiter").With("api").Value())
+}
@@ -0,0 +1,103 @@
+package xhandler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// Completion describes a completed request, passed to the functions
+// registered with AfterResponse.
+type Completion struct {
+	// Status is the status code sent, 0 if nothing was written.
+	Status int
+	// Size is the number of body bytes written.
+	Size int64
+	// Duration is the time spent serving the request.
+	Duration time.Duration
+	// Panic is the value passed to panic by a sub handler, nil if the
+	// handler returned normally.
+	Panic interface{}
+	// Stack is the stack of the panicking handler, nil if it returned
+	// normally.
+	Stack []byte
+}
+
+type afterResponseCtxKey struct{}
+
+type afterResponseHooks struct {
+	mu    sync.Mutex
+	hooks []func(ctx context.Context, c Completion)
+	done  bool
+}
+
+// AfterResponse registers f to be called once the request completed, to
+// release per-request resources or emit events like audit records. It
+// returns false, without registering f, if the AfterResponseHandler
+// middleware is not installed or the request already completed.
+func AfterResponse(ctx context.Context, f func(ctx context.Context, c Completion)) bool {
+	h, ok := ctx.Value(afterResponseCtxKey{}).(*afterResponseHooks)
+	if !ok {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done {
+		return false
+	}
+	h.hooks = append(h.hooks, f)
+	return true
+}
+
+// AfterResponseHandler lets handlers and middleware down the chain register
+// functions with AfterResponse. They are called, last registered first,
+// once the handler returned or panicked, with the final status, size and
+// duration of the request and the panic value if any. A panicking function
+// does not prevent the others from running. The panic of the handler, or
+// else the first one of the functions, is then propagated.
+//
+// Install it at the beginning of the chain so the response sent by
+// RecoverHandler and the time spent in all the middleware are reported.
+func AfterResponseHandler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h := &afterResponseHooks{}
+		rw := wrapWriter(w)
+		defer rw.watchPanic(func(hp *handlerPanic) {
+			c := Completion{
+				Status:   rw.Status(),
+				Size:     rw.Size(),
+				Duration: time.Since(start),
+			}
+			if hp != nil {
+				c.Panic, c.Stack = hp.value, hp.stack
+			}
+			h.mu.Lock()
+			h.done = true
+			hooks := h.hooks
+			h.mu.Unlock()
+			var p interface{}
+			for i := len(hooks) - 1; i >= 0; i-- {
+				if v := runAfterResponse(ctx, hooks[i], c); p == nil {
+					p = v
+				}
+			}
+			if hp == nil && p != nil {
+				// The panic of the handler, if any, goes on once we return
+				panic(p)
+			}
+		})
+		next.ServeHTTPC(context.WithValue(ctx, afterResponseCtxKey{}, h), rw, r)
+	})
+}
+
+// runAfterResponse calls f, returning its panic value if it panicked.
+func runAfterResponse(ctx context.Context, f func(ctx context.Context, c Completion), c Completion) (p interface{}) {
+	defer func() {
+		p = recover()
+	}()
+	f(ctx, c)
+	return nil
+}
@@ -0,0 +1,111 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAfterResponseHandler(t *testing.T) {
+	var calls []string
+	var got Completion
+	c := Chain{}
+	c.UseC(AfterResponseHandler)
+	c.UseC(func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			assert.True(t, AfterResponse(ctx, func(ctx context.Context, c Completion) {
+				calls = append(calls, "middleware")
+				got = c
+			}))
+			next.ServeHTTPC(ctx, w, r)
+		})
+	})
+	var saved context.Context
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		saved = ctx
+		AfterResponse(ctx, func(ctx context.Context, c Completion) {
+			calls = append(calls, "handler")
+		})
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, []string{"handler", "middleware"}, calls)
+	assert.Equal(t, http.StatusCreated, got.Status)
+	assert.Equal(t, int64(5), got.Size)
+	assert.True(t, got.Duration >= 5*time.Millisecond)
+	assert.Nil(t, got.Panic)
+
+	assert.False(t, AfterResponse(saved, func(context.Context, Completion) {}), "request completed")
+	assert.False(t, AfterResponse(context.Background(), func(context.Context, Completion) {}), "not installed")
+}
+
+func TestAfterResponseHandlerPanic(t *testing.T) {
+	var got Completion
+	h := AfterResponseHandler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AfterResponse(ctx, func(ctx context.Context, c Completion) {
+			got = c
+		})
+		panic("boom")
+	}))
+	assert.PanicsWithValue(t, "boom", func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	})
+	assert.Equal(t, "boom", got.Panic)
+	assert.Contains(t, string(got.Stack), "TestAfterResponseHandlerPanic.func1", "stack of the handler")
+	assert.Equal(t, 0, got.Status)
+
+	// Recovered panics are reported with the error response
+	c := Chain{}
+	c.UseC(AfterResponseHandler)
+	c.UseC(RecoverHandler(RecoverOptions{}))
+	h = c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AfterResponse(ctx, func(ctx context.Context, c Completion) {
+			got = c
+		})
+		panic("boom")
+	})
+	assert.NotPanics(t, func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	})
+	assert.Nil(t, got.Panic)
+	assert.Nil(t, got.Stack)
+	assert.Equal(t, http.StatusInternalServerError, got.Status)
+}
+
+func TestAfterResponseHookPanic(t *testing.T) {
+	var calls []string
+	hook := func(name string, panics bool) func(context.Context, Completion) {
+		return func(ctx context.Context, c Completion) {
+			calls = append(calls, name)
+			if panics {
+				panic(name)
+			}
+		}
+	}
+	h := AfterResponseHandler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AfterResponse(ctx, hook("first", false))
+		AfterResponse(ctx, hook("second", true))
+		AfterResponse(ctx, hook("third", true))
+		if r.URL.Path == "/panic" {
+			panic("handler")
+		}
+	}))
+	assert.PanicsWithValue(t, "third", func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	})
+	assert.Equal(t, []string{"third", "second", "first"}, calls)
+
+	calls = nil
+	r, _ := http.NewRequest("GET", "/panic", nil)
+	assert.PanicsWithValue(t, "handler", func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	})
+	assert.Equal(t, []string{"third", "second", "first"}, calls)
+}
@@ -0,0 +1,121 @@
+package xhandler
+
+import (
+	"errors"
+	"runtime/debug"
+
+	"context"
+)
+
+var (
+	// ErrBackgroundFull is returned by BackgroundGroup.Go when the maximum
+	// number of background goroutines is reached.
+	ErrBackgroundFull = errors.New("xhandler: too many background goroutines")
+	// ErrNoBackground is returned by GoBackground when the context carries
+	// no BackgroundGroup.
+	ErrNoBackground = errors.New("xhandler: no background group in context")
+)
+
+// Detach returns a context carrying the values of ctx (request ID, trace
+// span, baggage...) but neither its deadline nor its cancellation, so work
+// started from a request is not canceled by CloseHandler or TimeoutHandler
+// when the request ends.
+func Detach(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// BackgroundGroup tracks goroutines started from requests which outlive
+// them, like cache warming or analytics, so they can be bounded and waited
+// for on shutdown. Their context carries the values of the request context
+// but is only canceled with the group context.
+//
+// Server has a group bound to its root context and waited for by Shutdown;
+// use GoBackground to start goroutines in it from handlers.
+type BackgroundGroup struct {
+	// Max is the maximum number of goroutines running at once. Zero means
+	// no limit.
+	Max int
+	// Reporter receives the panics of the goroutines, recovered so they
+	// don't crash the process. If nil, panics are not recovered.
+	Reporter PanicReporter
+
+	ctx     context.Context
+	running activeCount
+}
+
+// NewBackgroundGroup creates a group whose goroutine contexts are canceled
+// with ctx.
+func NewBackgroundGroup(ctx context.Context, max int) *BackgroundGroup {
+	return &BackgroundGroup{Max: max, ctx: ctx}
+}
+
+// Go runs f in a new goroutine with a context carrying the values of ctx
+// and canceled with the group context. It fails with ErrBackgroundFull if
+// Max goroutines are running, and with the group context cause if it is
+// canceled.
+func (g *BackgroundGroup) Go(ctx context.Context, f func(ctx context.Context)) error {
+	if g.ctx.Err() != nil {
+		return context.Cause(g.ctx)
+	}
+	if !g.running.tryAdd(g.Max) {
+		return ErrBackgroundFull
+	}
+	ctx, cancel := context.WithCancelCause(Detach(ctx))
+	stop := context.AfterFunc(g.ctx, func() {
+		cancel(context.Cause(g.ctx))
+	})
+	go func() {
+		defer func() {
+			stop()
+			cancel(nil)
+			g.running.add(-1)
+		}()
+		if g.Reporter != nil {
+			defer func() {
+				if v := recover(); v != nil {
+					g.Reporter.ReportPanic(ctx, Panic{Value: v, Stack: debug.Stack()})
+				}
+			}()
+		}
+		f(ctx)
+	}()
+	return nil
+}
+
+// Running returns the number of goroutines running.
+func (g *BackgroundGroup) Running() int {
+	return g.running.count()
+}
+
+// Wait waits for the running goroutines to return, or until ctx expires in
+// which case the ctx error is returned.
+func (g *BackgroundGroup) Wait(ctx context.Context) error {
+	return g.running.wait(ctx)
+}
+
+type backgroundCtxKey struct{}
+
+// WithBackgroundGroup returns a copy of ctx carrying g, for GoBackground.
+func WithBackgroundGroup(ctx context.Context, g *BackgroundGroup) context.Context {
+	return context.WithValue(ctx, backgroundCtxKey{}, g)
+}
+
+// BackgroundGroupFromContext returns the group stored in ctx, or nil.
+func BackgroundGroupFromContext(ctx context.Context) *BackgroundGroup {
+	g, _ := ctx.Value(backgroundCtxKey{}).(*BackgroundGroup)
+	return g
+}
+
+// GoBackground runs f in the background group of ctx, like the one of the
+// Server, keeping the ctx values:
+//
+//  xhandler.GoBackground(ctx, func(ctx context.Context) {
+//      cache.Warm(ctx, key)
+//  })
+func GoBackground(ctx context.Context, f func(ctx context.Context)) error {
+	g := BackgroundGroupFromContext(ctx)
+	if g == nil {
+		return ErrNoBackground
+	}
+	return g.Go(ctx, f)
+}
@@ -0,0 +1,92 @@
+package xhandler
+
+import (
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetach(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), contextKey, "value"), time.Second)
+	d := Detach(ctx)
+	cancel()
+	assert.NoError(t, d.Err())
+	_, ok := d.Deadline()
+	assert.False(t, ok)
+	assert.Equal(t, "value", d.Value(contextKey))
+}
+
+func TestBackgroundGroup(t *testing.T) {
+	root, stop := context.WithCancelCause(context.Background())
+	g := NewBackgroundGroup(root, 2)
+	req, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey, "value"))
+
+	release := make(chan struct{})
+	values := make(chan interface{}, 2)
+	errs := make(chan error, 2)
+	f := func(ctx context.Context) {
+		values <- ctx.Value(contextKey)
+		<-release
+		errs <- ctx.Err()
+	}
+	assert.NoError(t, g.Go(req, f))
+	assert.NoError(t, g.Go(req, f))
+	assert.Equal(t, ErrBackgroundFull, g.Go(req, f))
+	assert.Equal(t, 2, g.Running())
+	assert.Equal(t, "value", <-values)
+	assert.Equal(t, "value", <-values)
+
+	// The end of the request doesn't cancel the goroutines
+	cancel()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer waitCancel()
+	assert.Equal(t, context.DeadlineExceeded, g.Wait(waitCtx))
+
+	close(release)
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+	assert.NoError(t, g.Wait(context.Background()))
+	assert.Equal(t, 0, g.Running())
+
+	// The group context does
+	done := make(chan error)
+	assert.NoError(t, g.Go(req, func(ctx context.Context) {
+		<-ctx.Done()
+		done <- context.Cause(ctx)
+	}))
+	stop(ErrServerShutdown)
+	assert.Equal(t, ErrServerShutdown, <-done)
+	assert.Equal(t, ErrServerShutdown, g.Go(req, f))
+}
+
+func TestBackgroundGroupPanic(t *testing.T) {
+	reported := make(chan Panic, 1)
+	g := NewBackgroundGroup(context.Background(), 0)
+	g.Reporter = PanicReporterFunc(func(ctx context.Context, p Panic) {
+		assert.Equal(t, "value", ctx.Value(contextKey))
+		reported <- p
+	})
+	ctx := context.WithValue(context.Background(), contextKey, "value")
+	assert.NoError(t, g.Go(ctx, func(ctx context.Context) {
+		panic("boom")
+	}))
+	p := <-reported
+	assert.Equal(t, "boom", p.Value)
+	assert.NotEmpty(t, p.Stack)
+	assert.NoError(t, g.Wait(context.Background()))
+}
+
+func TestGoBackground(t *testing.T) {
+	assert.Equal(t, ErrNoBackground, GoBackground(context.Background(), func(context.Context) {}))
+
+	g := NewBackgroundGroup(context.Background(), 0)
+	done := make(chan struct{})
+	ctx := WithBackgroundGroup(context.Background(), g)
+	assert.Equal(t, g, BackgroundGroupFromContext(ctx))
+	assert.NoError(t, GoBackground(ctx, func(context.Context) { close(done) }))
+	<-done
+	assert.NoError(t, g.Wait(context.Background()))
+}
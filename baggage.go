@@ -0,0 +1,296 @@
+package xhandler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"context"
+)
+
+// Limits of the W3C Baggage specification. A baggage exceeding them is not
+// propagated in full.
+const (
+	MaxBaggageMembers = 64
+	MaxBaggageBytes   = 8192
+)
+
+var (
+	// ErrInvalidBaggage is returned when a baggage header or member does not
+	// follow the W3C Baggage syntax.
+	ErrInvalidBaggage = errors.New("xhandler: invalid baggage")
+	// ErrBaggageTooLarge is returned when adding a member would make the
+	// baggage exceed MaxBaggageMembers or MaxBaggageBytes.
+	ErrBaggageTooLarge = errors.New("xhandler: baggage too large")
+)
+
+// BaggageProperty is a property of a baggage member, with an optional
+// value.
+type BaggageProperty struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+// BaggageMember is a key/value pair of a baggage with its properties. The
+// value is stored decoded.
+type BaggageMember struct {
+	Key        string
+	Value      string
+	Properties []BaggageProperty
+}
+
+// Baggage is a W3C Baggage: the set of key/value pairs propagated along a
+// request through services, like a tenant or an experiment identifier.
+// Baggage is immutable: With and Without return modified copies, so it can
+// be safely shared between goroutines. The zero value is an empty baggage.
+type Baggage struct {
+	members []BaggageMember
+}
+
+// ParseBaggage parses a baggage header value. Members with an empty value
+// are kept and empty list members, like after a trailing comma, are
+// skipped. The whole header is rejected if a member is invalid. Parsing
+// stops at the first member exceeding the size limits: it and the following
+// members are dropped and ErrBaggageTooLarge returned with the baggage
+// holding the members within the limits.
+func ParseBaggage(header string) (Baggage, error) {
+	var b Baggage
+	for rest, more := header, true; more; {
+		var s string
+		s, rest, more = strings.Cut(rest, ",")
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		m, err := parseBaggageMember(s)
+		if err != nil {
+			return Baggage{}, err
+		}
+		if b, err = b.With(m); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func parseBaggageMember(s string) (BaggageMember, error) {
+	var m BaggageMember
+	parts := strings.Split(s, ";")
+	k, v, found := strings.Cut(parts[0], "=")
+	if !found {
+		return m, ErrInvalidBaggage
+	}
+	var err error
+	if m.Key, m.Value, err = parseBaggagePair(k, v); err != nil {
+		return m, err
+	}
+	for _, p := range parts[1:] {
+		var prop BaggageProperty
+		k, v, found := strings.Cut(p, "=")
+		if found {
+			prop.HasValue = true
+			if prop.Key, prop.Value, err = parseBaggagePair(k, v); err != nil {
+				return m, err
+			}
+		} else if prop.Key = strings.TrimSpace(k); !isToken(prop.Key) {
+			return m, ErrInvalidBaggage
+		}
+		m.Properties = append(m.Properties, prop)
+	}
+	return m, nil
+}
+
+func parseBaggagePair(k, v string) (string, string, error) {
+	k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+	if !isToken(k) {
+		return "", "", ErrInvalidBaggage
+	}
+	for i := 0; i < len(v); i++ {
+		if !isBaggageOctet(v[i]) {
+			return "", "", ErrInvalidBaggage
+		}
+	}
+	v, err := url.PathUnescape(v)
+	if err != nil {
+		return "", "", ErrInvalidBaggage
+	}
+	return k, v, nil
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !isTokenChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenChar tells if r is allowed in an HTTP token (RFC 9110).
+func isTokenChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// isBaggageOctet tells if c is allowed unencoded in a baggage value.
+func isBaggageOctet(c byte) bool {
+	return c == 0x21 || c >= 0x23 && c <= 0x2b || c >= 0x2d && c <= 0x3a || c >= 0x3c && c <= 0x5b || c >= 0x5d && c <= 0x7e
+}
+
+func (m BaggageMember) clone() BaggageMember {
+	m.Properties = append([]BaggageProperty(nil), m.Properties...)
+	return m
+}
+
+// Len returns the number of members.
+func (b Baggage) Len() int {
+	return len(b.members)
+}
+
+// Members returns a copy of the members.
+func (b Baggage) Members() []BaggageMember {
+	ms := make([]BaggageMember, len(b.members))
+	for i, m := range b.members {
+		ms[i] = m.clone()
+	}
+	return ms
+}
+
+// Member returns the member with the given key.
+func (b Baggage) Member(key string) (BaggageMember, bool) {
+	for _, m := range b.members {
+		if m.Key == key {
+			return m.clone(), true
+		}
+	}
+	return BaggageMember{}, false
+}
+
+// Value returns the value of the member with the given key, or an empty
+// string.
+func (b Baggage) Value(key string) string {
+	m, _ := b.Member(key)
+	return m.Value
+}
+
+// With returns a copy of b with the member m added, replacing a member with
+// the same key. It fails if m is invalid or the result would exceed the
+// size limits.
+func (b Baggage) With(m BaggageMember) (Baggage, error) {
+	if !isToken(m.Key) {
+		return b, ErrInvalidBaggage
+	}
+	for _, p := range m.Properties {
+		if !isToken(p.Key) {
+			return b, ErrInvalidBaggage
+		}
+	}
+	m = m.clone()
+	n := Baggage{members: make([]BaggageMember, 0, len(b.members)+1)}
+	for _, o := range b.members {
+		if o.Key != m.Key {
+			n.members = append(n.members, o)
+		}
+	}
+	n.members = append(n.members, m)
+	if len(n.members) > MaxBaggageMembers || len(n.String()) > MaxBaggageBytes {
+		return b, ErrBaggageTooLarge
+	}
+	return n, nil
+}
+
+// Without returns a copy of b without the member with the given key.
+func (b Baggage) Without(key string) Baggage {
+	n := Baggage{}
+	for _, m := range b.members {
+		if m.Key != key {
+			n.members = append(n.members, m)
+		}
+	}
+	return n
+}
+
+// String returns the baggage header value, values being percent-encoded.
+func (b Baggage) String() string {
+	var sb strings.Builder
+	for i, m := range b.members {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(m.Key)
+		sb.WriteByte('=')
+		sb.WriteString(encodeBaggageValue(m.Value))
+		for _, p := range m.Properties {
+			sb.WriteByte(';')
+			sb.WriteString(p.Key)
+			if p.HasValue {
+				sb.WriteByte('=')
+				sb.WriteString(encodeBaggageValue(p.Value))
+			}
+		}
+	}
+	return sb.String()
+}
+
+func encodeBaggageValue(v string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if isBaggageOctet(c) && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[c>>4])
+		sb.WriteByte(hex[c&15])
+	}
+	return sb.String()
+}
+
+type baggageCtxKey struct{}
+
+// BaggageFromContext returns the baggage stored in ctx, empty if none.
+func BaggageFromContext(ctx context.Context) Baggage {
+	b, _ := ctx.Value(baggageCtxKey{}).(Baggage)
+	return b
+}
+
+// ContextWithBaggage returns a copy of ctx carrying b.
+func ContextWithBaggage(ctx context.Context, b Baggage) context.Context {
+	return context.WithValue(ctx, baggageCtxKey{}, b)
+}
+
+// SetBaggage returns a copy of ctx whose baggage has the member key set to
+// value, so it is propagated to the services called with the context.
+func SetBaggage(ctx context.Context, key, value string) (context.Context, error) {
+	b, err := BaggageFromContext(ctx).With(BaggageMember{Key: key, Value: value})
+	if err != nil {
+		return ctx, err
+	}
+	return ContextWithBaggage(ctx, b), nil
+}
+
+// BaggageHandler stores the baggage of the request baggage header in the
+// context. Invalid headers are ignored and members beyond the size limits
+// dropped.
+func BaggageHandler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		h := strings.Join(r.Header.Values("baggage"), ",")
+		if b, _ := ParseBaggage(h); b.Len() > 0 {
+			ctx = ContextWithBaggage(ctx, b)
+		}
+		next.ServeHTTPC(ctx, w, r)
+	})
+}
+
+// BaggageTransport sets the baggage header of outgoing requests from the
+// baggage of their context.
+func BaggageTransport(next http.RoundTripper) http.RoundTripper {
+	return HeaderTransport("baggage", func(ctx context.Context) string {
+		return BaggageFromContext(ctx).String()
+	})(next)
+}
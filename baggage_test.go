@@ -0,0 +1,131 @@
+package xhandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBaggage(t *testing.T) {
+	b, err := ParseBaggage("tenant=acme, exp = a%2Cb ;ttl=60;public,empty=")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, b.Len())
+	assert.Equal(t, "acme", b.Value("tenant"))
+	assert.Equal(t, "", b.Value("missing"))
+	m, found := b.Member("exp")
+	assert.True(t, found)
+	assert.Equal(t, BaggageMember{
+		Key:   "exp",
+		Value: "a,b",
+		Properties: []BaggageProperty{
+			{Key: "ttl", Value: "60", HasValue: true},
+			{Key: "public"},
+		},
+	}, m)
+	_, found = b.Member("empty")
+	assert.True(t, found)
+	assert.Equal(t, "tenant=acme,exp=a%2Cb;ttl=60;public,empty=", b.String())
+
+	b, err = ParseBaggage("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.Len())
+
+	b, err = ParseBaggage("a=1,, b=2 ,")
+	assert.NoError(t, err)
+	assert.Equal(t, "a=1,b=2", b.String(), "empty list members are skipped")
+
+	for _, h := range []string{
+		"novalue",
+		"=value",
+		"key with space=1",
+		`quoted="value"`,
+		"k=a b",
+		"k=%zz",
+		"k=1;bad prop",
+	} {
+		b, err := ParseBaggage(h)
+		assert.Equal(t, ErrInvalidBaggage, err, h)
+		assert.Equal(t, 0, b.Len(), h)
+	}
+}
+
+func TestBaggageLimits(t *testing.T) {
+	members := make([]string, MaxBaggageMembers+1)
+	for i := range members {
+		members[i] = fmt.Sprintf("k%d=v", i)
+	}
+	b, err := ParseBaggage(strings.Join(members, ","))
+	assert.Equal(t, ErrBaggageTooLarge, err)
+	assert.Equal(t, MaxBaggageMembers, b.Len())
+	assert.Equal(t, "", b.Value(fmt.Sprintf("k%d", MaxBaggageMembers)))
+
+	big := strings.Repeat("x", MaxBaggageBytes/2)
+	b, err = ParseBaggage("a=" + big + ",b=" + big + ",c=small")
+	assert.Equal(t, ErrBaggageTooLarge, err)
+	assert.Equal(t, 1, b.Len())
+	assert.Equal(t, "", b.Value("c"), "parsing stops at the limits")
+	assert.True(t, len(b.String()) <= MaxBaggageBytes)
+}
+
+func TestBaggageImmutable(t *testing.T) {
+	b, _ := ParseBaggage("a=1,b=2")
+	b2, err := b.With(BaggageMember{Key: "a", Value: "one two"})
+	assert.NoError(t, err)
+	assert.Equal(t, "a=1,b=2", b.String())
+	assert.Equal(t, "b=2,a=one%20two", b2.String())
+
+	b3 := b2.Without("b")
+	assert.Equal(t, "a=one%20two", b3.String())
+	assert.Equal(t, 2, b2.Len())
+
+	ms := b.Members()
+	ms[0].Value = "changed"
+	assert.Equal(t, "1", b.Value("a"))
+
+	_, err = b.With(BaggageMember{Key: "bad key"})
+	assert.Equal(t, ErrInvalidBaggage, err)
+	_, err = b.With(BaggageMember{Key: "k", Properties: []BaggageProperty{{Key: ""}}})
+	assert.Equal(t, ErrInvalidBaggage, err)
+
+	// Values round trip through the header encoding
+	b4, _ := Baggage{}.With(BaggageMember{Key: "k", Value: `100% "weird";,\ é`})
+	b5, err := ParseBaggage(b4.String())
+	assert.NoError(t, err)
+	assert.Equal(t, `100% "weird";,\ é`, b5.Value("k"))
+}
+
+func TestBaggageHandler(t *testing.T) {
+	var got Baggage
+	h := BaggageHandler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		ctx, err := SetBaggage(ctx, "experiment", "b")
+		assert.NoError(t, err)
+		got = BaggageFromContext(ctx)
+	}))
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Add("baggage", "tenant=acme")
+	r.Header.Add("baggage", "region=eu")
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	assert.Equal(t, "tenant=acme,region=eu,experiment=b", got.String())
+
+	r.Header.Set("baggage", "invalid")
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	assert.Equal(t, "experiment=b", got.String())
+}
+
+func TestBaggageTransport(t *testing.T) {
+	rt := &recordTransport{status: 200}
+	client := TransportChain{BaggageTransport}.Client(&http.Client{Transport: rt})
+	ctx, _ := SetBaggage(context.Background(), "tenant", "acme")
+	req, _ := http.NewRequest("GET", "http://backend/", nil)
+	client.Do(req.WithContext(ctx))
+	assert.Equal(t, "tenant=acme", rt.last.Header.Get("baggage"))
+
+	client.Do(req)
+	assert.Empty(t, rt.last.Header.Get("baggage"))
+}
@@ -0,0 +1,122 @@
+package xhandler
+
+import (
+	"net/http"
+	"time"
+
+	"context"
+)
+
+// BudgetOptions configures BudgetHandler.
+type BudgetOptions struct {
+	// Name identifies the budget in metrics.
+	Name string
+	// Timeout is the maximum time given to a request. A shorter deadline of
+	// the parent context, like one set by DeadlineHandler, is honored. Zero
+	// means only the parent deadline applies.
+	Timeout time.Duration
+	// Headroom is the time reserved, at the end of the budget, for writing
+	// the response: the context given to the handler expires Headroom
+	// before the request deadline.
+	Headroom time.Duration
+	// Registry, if set, receives a request_budget_remaining_seconds
+	// histogram of the budget of requests when they arrive and a
+	// request_budget_exhausted_total counter labelled by budget and phase:
+	// "arrival" for requests rejected as their budget was already
+	// exhausted, "handler" for requests whose handler ran out of time.
+	Registry *Registry
+}
+
+// BudgetHandler returns a handler setting a deadline on the request context
+// from the time budget of the request: the parent context deadline and
+// Timeout, whichever comes first, minus Headroom.
+//
+// Requests without budget left get a 504 Gateway Timeout response without
+// being served, as do requests whose handler gave up on the deadline
+// without writing a response. Handlers can check the remaining budget with
+// RemainingBudget and HasBudget, and give a share of it to downstream calls
+// with WithSubBudget.
+func BudgetHandler(o BudgetOptions) func(next HandlerC) HandlerC {
+	var remaining *HistogramVec
+	var exhausted *CounterVec
+	if o.Registry != nil {
+		remaining = o.Registry.Histogram("request_budget_remaining_seconds",
+			"Time budget of requests when they arrive.", nil, "budget")
+		exhausted = o.Registry.Counter("request_budget_exhausted_total",
+			"Number of requests which ran out of time budget.", "budget", "phase")
+	}
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			deadline, ok := ctx.Deadline()
+			if o.Timeout > 0 && (!ok || now.Add(o.Timeout).Before(deadline)) {
+				deadline, ok = now.Add(o.Timeout), true
+			}
+			if !ok {
+				next.ServeHTTPC(ctx, w, r)
+				return
+			}
+			if remaining != nil {
+				remaining.With(o.Name).Observe(deadline.Sub(now).Seconds())
+			}
+			deadline = deadline.Add(-o.Headroom)
+			if !deadline.After(now) {
+				if exhausted != nil {
+					exhausted.With(o.Name, "arrival").Inc()
+				}
+				http.Error(w, "Deadline exceeded", http.StatusGatewayTimeout)
+				return
+			}
+			ctx, cancel := context.WithDeadline(ctx, deadline)
+			defer cancel()
+			rw := wrapWriter(w)
+			next.ServeHTTPC(ctx, rw, r)
+			if ctx.Err() == context.DeadlineExceeded {
+				if exhausted != nil {
+					exhausted.With(o.Name, "handler").Inc()
+				}
+				if !rw.Written() {
+					http.Error(rw, "Deadline exceeded", http.StatusGatewayTimeout)
+				}
+			}
+		})
+	}
+}
+
+// RemainingBudget returns the time left before the ctx deadline, negative
+// if it passed. ok is false if ctx has no deadline.
+func RemainingBudget(ctx context.Context) (d time.Duration, ok bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// HasBudget tells if there is at least d left before the ctx deadline, to
+// decide if optional work (like filling a cache) can be done. It is true
+// if ctx has no deadline.
+func HasBudget(ctx context.Context, d time.Duration) bool {
+	remaining, ok := RemainingBudget(ctx)
+	return !ok || remaining >= d
+}
+
+// WithSubBudget returns a context for a downstream call whose deadline keeps
+// reserve out of the remaining budget of ctx, so the caller has time to
+// process the result, and is at most max away if max is positive. If the
+// budget is smaller than reserve, the returned context is already expired.
+func WithSubBudget(ctx context.Context, max, reserve time.Duration) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.Add(-reserve)
+	}
+	if max > 0 {
+		if d := time.Now().Add(max); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
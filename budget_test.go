@@ -0,0 +1,106 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudgetHandler(t *testing.T) {
+	reg := NewRegistry()
+	var remaining time.Duration
+	var hasDeadline bool
+	h := BudgetHandler(BudgetOptions{Name: "api", Timeout: time.Second, Headroom: 100 * time.Millisecond, Registry: reg})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		remaining, hasDeadline = RemainingBudget(ctx)
+		if r.URL.Path == "/slow" {
+			<-ctx.Done()
+		}
+	}))
+	serve := func(ctx context.Context, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		h.ServeHTTPC(ctx, w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, serve(context.Background(), "/").Code)
+	assert.True(t, hasDeadline)
+	assert.InDelta(t, 900*time.Millisecond, remaining, float64(20*time.Millisecond))
+
+	// A shorter parent deadline wins
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, http.StatusOK, serve(ctx, "/").Code)
+	assert.InDelta(t, 200*time.Millisecond, remaining, float64(20*time.Millisecond))
+
+	// Budget smaller than the headroom
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	remaining = 0
+	assert.Equal(t, http.StatusGatewayTimeout, serve(ctx, "/").Code)
+	assert.Equal(t, time.Duration(0), remaining, "handler not called")
+
+	// The handler runs out of time, the headroom is left to answer
+	ctx, cancel = context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	w := serve(ctx, "/slow")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.NoError(t, ctx.Err())
+
+	exhausted := reg.Counter("request_budget_exhausted_total", "", "budget", "phase")
+	assert.Equal(t, 1.0, exhausted.With("api", "arrival").Value())
+	assert.Equal(t, 1.0, exhausted.With("api", "handler").Value())
+	assert.Equal(t, uint64(4), reg.Histogram("request_budget_remaining_seconds", "", nil, "budget").With("api").Count())
+}
+
+func TestBudgetHandlerNoDeadline(t *testing.T) {
+	var hasDeadline bool
+	h := BudgetHandler(BudgetOptions{Headroom: time.Second})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = ctx.Deadline()
+	}))
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, hasDeadline)
+}
+
+func TestBudgetHelpers(t *testing.T) {
+	bg := context.Background()
+	_, ok := RemainingBudget(bg)
+	assert.False(t, ok)
+	assert.True(t, HasBudget(bg, time.Hour))
+
+	ctx, cancel := context.WithTimeout(bg, time.Second)
+	defer cancel()
+	assert.True(t, HasBudget(ctx, 500*time.Millisecond))
+	assert.False(t, HasBudget(ctx, 2*time.Second))
+
+	sub, cancel := WithSubBudget(ctx, 0, 200*time.Millisecond)
+	defer cancel()
+	d, _ := RemainingBudget(sub)
+	assert.InDelta(t, 800*time.Millisecond, d, float64(20*time.Millisecond))
+
+	sub, cancel = WithSubBudget(ctx, 100*time.Millisecond, 200*time.Millisecond)
+	defer cancel()
+	d, _ = RemainingBudget(sub)
+	assert.InDelta(t, 100*time.Millisecond, d, float64(20*time.Millisecond))
+
+	sub, cancel = WithSubBudget(ctx, 0, 2*time.Second)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, sub.Err())
+
+	sub, cancel = WithSubBudget(bg, 0, time.Second)
+	defer cancel()
+	_, ok = sub.Deadline()
+	assert.False(t, ok)
+	sub, cancel = WithSubBudget(bg, time.Second, 0)
+	defer cancel()
+	d, _ = RemainingBudget(sub)
+	assert.InDelta(t, time.Second, d, float64(20*time.Millisecond))
+}
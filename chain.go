@@ -2,6 +2,10 @@ package xhandler
 
 import (
 	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"context"
 )
@@ -119,3 +123,123 @@ func (c Chain) HandlerC(xh HandlerC) HandlerC {
 func (c Chain) HandlerCF(xhc HandlerFuncC) HandlerC {
 	return c.HandlerC(HandlerFuncC(xhc))
 }
+
+// Stage identifies an entry of a chain, or its final handler, for the hooks
+// passed to Instrument.
+type Stage struct {
+	// Index is the position of the entry in the chain. The final handler
+	// index is the length of the chain.
+	Index int
+	// Name is derived from the name of the entry's function.
+	Name string
+	// Final is true for the final handler.
+	Final bool
+}
+
+func (s Stage) String() string {
+	return strconv.Itoa(s.Index) + ":" + s.Name
+}
+
+// StageHook wraps the handler of a chain stage. The handler it receives
+// runs the stage and, if the stage calls its next handler, all the
+// following stages.
+type StageHook func(s Stage, h HandlerC) HandlerC
+
+// Instrument returns the chain with each entry and the final handler
+// wrapped by the given hooks, in order. Hooks are invoked once when the
+// chain handler is built, not on each request.
+//
+// The instrumented chain can't be extended any further, add the middleware
+// to c before instrumenting it.
+func (c Chain) Instrument(hooks ...StageHook) InstrumentedChain {
+	n := make(Chain, len(c))
+	copy(n, c)
+	return InstrumentedChain{chain: n, hooks: hooks}
+}
+
+// InstrumentedChain is a chain whose stages are wrapped by hooks, returned
+// by Chain.Instrument. It has the handler building methods of Chain.
+type InstrumentedChain struct {
+	chain Chain
+	hooks []StageHook
+}
+
+// stages returns the chain with its entries wrapped by the hooks, plus an
+// entry wrapping the final handler.
+func (c InstrumentedChain) stages() Chain {
+	n := make(Chain, 0, len(c.chain)+1)
+	for i, f := range c.chain {
+		n = append(n, instrumentEntry(Stage{Index: i, Name: funcName(f)}, f, c.hooks))
+	}
+	final := len(c.chain)
+	n = append(n, func(next HandlerC) HandlerC {
+		return wrapStage(Stage{Index: final, Name: funcName(next), Final: true}, next, c.hooks)
+	})
+	return n
+}
+
+// Handler is like Chain.Handler.
+func (c InstrumentedChain) Handler(xh HandlerC) http.Handler {
+	return c.stages().Handler(xh)
+}
+
+// HandlerFC is like Chain.HandlerFC.
+func (c InstrumentedChain) HandlerFC(xhf HandlerFuncC) http.Handler {
+	return c.stages().HandlerFC(xhf)
+}
+
+// HandlerH is like Chain.HandlerH.
+func (c InstrumentedChain) HandlerH(h http.Handler) http.Handler {
+	return c.stages().HandlerH(h)
+}
+
+// HandlerF is like Chain.HandlerF.
+func (c InstrumentedChain) HandlerF(hf http.HandlerFunc) http.Handler {
+	return c.stages().HandlerF(hf)
+}
+
+// HandlerCtx is like Chain.HandlerCtx.
+func (c InstrumentedChain) HandlerCtx(ctx context.Context, xh HandlerC) http.Handler {
+	return c.stages().HandlerCtx(ctx, xh)
+}
+
+// HandlerC is like Chain.HandlerC.
+func (c InstrumentedChain) HandlerC(xh HandlerC) HandlerC {
+	return c.stages().HandlerC(xh)
+}
+
+// HandlerCF is like Chain.HandlerCF.
+func (c InstrumentedChain) HandlerCF(xhc HandlerFuncC) HandlerC {
+	return c.stages().HandlerCF(xhc)
+}
+
+func instrumentEntry(s Stage, f func(next HandlerC) HandlerC, hooks []StageHook) func(next HandlerC) HandlerC {
+	return func(next HandlerC) HandlerC {
+		return wrapStage(s, f(next), hooks)
+	}
+}
+
+func wrapStage(s Stage, h HandlerC, hooks []StageHook) HandlerC {
+	for _, hook := range hooks {
+		h = hook(s, h)
+	}
+	return h
+}
+
+// funcName returns a short name for a middleware function or handler, like
+// "xhandler.CloseHandler".
+func funcName(f interface{}) string {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func {
+		return strings.TrimPrefix(reflect.TypeOf(f).String(), "*")
+	}
+	fn := runtime.FuncForPC(v.Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
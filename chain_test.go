@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"context"
 
@@ -210,3 +211,30 @@ func TestWith(t *testing.T) {
 	i.ServeHTTPC(mainCtx, nil, testRequest)
 	assert.Equal(t, 4, handlerCalls, "all handler called once")
 }
+
+func TestInstrument(t *testing.T) {
+	var stages []Stage
+	var calls []string
+	hook := func(s Stage, h HandlerC) HandlerC {
+		stages = append(stages, s)
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, s.String())
+			h.ServeHTTPC(ctx, w, r)
+		})
+	}
+	c := Chain{}
+	c.UseC(CloseHandler)
+	c.UseC(TimeoutHandler(time.Second))
+	ic := c.Instrument(hook)
+	c.UseC(CloseHandler)
+	h := ic.HandlerC(&handler{})
+	assert.Len(t, ic.chain, 2, "later entries of the chain are not instrumented")
+	assert.Equal(t, []Stage{
+		{Index: 2, Name: "xhandler.handler", Final: true},
+		{Index: 1, Name: "xhandler.TimeoutHandler.func1"},
+		{Index: 0, Name: "xhandler.CloseHandler"},
+	}, stages)
+
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, []string{"0:xhandler.CloseHandler", "1:xhandler.TimeoutHandler.func1", "2:xhandler.handler"}, calls)
+}
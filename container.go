@@ -0,0 +1,147 @@
+package xhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"context"
+)
+
+var (
+	// ErrNoProvider is returned when resolving a dependency without
+	// provider for the request.
+	ErrNoProvider = errors.New("xhandler: no provider")
+	// ErrContainerClosed is returned when resolving a dependency not built
+	// yet once the request ended.
+	ErrContainerClosed = errors.New("xhandler: request container closed")
+)
+
+// Provider builds a request-scoped dependency, like a database transaction
+// or a data loader. Its ctx carries the values of the ctx passed to Resolve
+// but is only canceled when the request ends, after the dependency is
+// disposed of. The dispose function, if not nil, is called when the request
+// ends to release it (for instance rolling back a transaction not committed
+// by the handler).
+type Provider func(ctx context.Context) (v interface{}, dispose func(), err error)
+
+type containerCtxKey struct{}
+
+type containerEntry struct {
+	provider Provider
+	once     sync.Once
+	v        interface{}
+	err      error
+}
+
+// container holds the dependencies of a request.
+type container struct {
+	mu       sync.Mutex
+	entries  map[interface{}]*containerEntry
+	disposes []func()
+	closed   bool
+}
+
+func (c *container) resolve(ctx context.Context, key interface{}) (interface{}, error) {
+	c.mu.Lock()
+	e, found := c.entries[key]
+	c.mu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("%w for %v", ErrNoProvider, key)
+	}
+	e.once.Do(func() {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			e.err = ErrContainerClosed
+			return
+		}
+		// The dependency lives as long as the request, not as the ctx of
+		// its first user which may have a shorter deadline
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		var dispose func()
+		defer func() {
+			v := recover()
+			if v != nil {
+				// The once is done, later calls get an error
+				e.v, e.err = nil, fmt.Errorf("xhandler: provider for %v panicked: %v", key, v)
+			}
+			c.release(func() {
+				if dispose != nil {
+					dispose()
+				}
+				cancel()
+			})
+			if v != nil {
+				panic(v)
+			}
+		}()
+		e.v, dispose, e.err = e.provider(ctx)
+	})
+	return e.v, e.err
+}
+
+// release registers f to be called when the request ends, or calls it now
+// if it already did.
+func (c *container) release(f func()) {
+	c.mu.Lock()
+	closed := c.closed
+	if !closed {
+		c.disposes = append(c.disposes, f)
+	}
+	c.mu.Unlock()
+	if closed {
+		// Built while the request ended
+		f()
+	}
+}
+
+// close disposes of the dependencies, last built first.
+func (c *container) close() {
+	c.mu.Lock()
+	c.closed = true
+	disposes := c.disposes
+	c.disposes = nil
+	c.mu.Unlock()
+	for i := len(disposes) - 1; i >= 0; i-- {
+		disposes[i]()
+	}
+}
+
+// Provide appends to the chain a middleware registering p as the provider of
+// the dependency identified by key for the requests going through it. The
+// dependency is built on the first Resolve of each request, and disposed of
+// when the request ends. Keys follow the context.WithValue rules.
+//
+// Providers registered later in the chain can resolve the dependencies of the
+// ones registered before. A provider must not resolve its own key.
+func (c *Chain) Provide(key interface{}, p Provider) {
+	c.UseC(func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			ct, found := ctx.Value(containerCtxKey{}).(*container)
+			if !found {
+				ct = &container{entries: map[interface{}]*containerEntry{}}
+				ctx = context.WithValue(ctx, containerCtxKey{}, ct)
+				defer ct.close()
+			}
+			ct.mu.Lock()
+			ct.entries[key] = &containerEntry{provider: p}
+			ct.mu.Unlock()
+			next.ServeHTTPC(ctx, w, r)
+		})
+	})
+}
+
+// Resolve returns the dependency identified by key for the request of ctx,
+// building it with its provider on first use. The provider error, if any,
+// is returned on every call. If the provider panics, the panic goes on and
+// later calls return an error.
+func Resolve(ctx context.Context, key interface{}) (interface{}, error) {
+	ct, found := ctx.Value(containerCtxKey{}).(*container)
+	if !found {
+		return nil, fmt.Errorf("%w for %v", ErrNoProvider, key)
+	}
+	return ct.resolve(ctx, key)
+}
@@ -0,0 +1,48 @@
+package xhandler
+
+import (
+	"fmt"
+
+	"context"
+)
+
+// typeKey is the container key of the dependencies provided by type.
+type typeKey[T any] struct{}
+
+func (typeKey[T]) String() string {
+	var v *T
+	return fmt.Sprintf("%T", v)[1:]
+}
+
+// ProvideType registers on c the provider of the request-scoped dependency
+// of type T, retrieved with ResolveType:
+//
+//  xhandler.ProvideType(&c, func(ctx context.Context) (*sql.Tx, func(), error) {
+//      tx, err := db.BeginTx(ctx, nil)
+//      if err != nil {
+//          return nil, nil, err
+//      }
+//      return tx, func() { tx.Rollback() }, nil
+//  })
+func ProvideType[T any](c *Chain, p func(ctx context.Context) (T, func(), error)) {
+	c.Provide(typeKey[T]{}, func(ctx context.Context) (interface{}, func(), error) {
+		return p(ctx)
+	})
+}
+
+// ResolveType returns the dependency of type T for the request of ctx,
+// building it on first use.
+func ResolveType[T any](ctx context.Context) (T, error) {
+	v, err := Resolve(ctx, typeKey[T]{})
+	t, _ := v.(T)
+	return t, err
+}
+
+// MustResolveType is like ResolveType but panics on error.
+func MustResolveType[T any](ctx context.Context) T {
+	t, err := ResolveType[T](ctx)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,35 @@
+package xhandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLoader struct {
+	user string
+}
+
+func TestProvideType(t *testing.T) {
+	c := Chain{}
+	ProvideType(&c, func(ctx context.Context) (*testLoader, func(), error) {
+		return &testLoader{user: "alice"}, nil, nil
+	})
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		l, err := ResolveType[*testLoader](ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", l.user)
+		assert.Equal(t, l, MustResolveType[*testLoader](ctx), "same instance")
+
+		_, err = ResolveType[testLoader](ctx)
+		assert.True(t, errors.Is(err, ErrNoProvider))
+		assert.EqualError(t, err, "xhandler: no provider for xhandler.testLoader")
+		assert.Panics(t, func() { MustResolveType[string](ctx) })
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+}
@@ -0,0 +1,123 @@
+package xhandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainer(t *testing.T) {
+	var calls []string
+	built := 0
+	c := Chain{}
+	c.Provide("db", func(ctx context.Context) (interface{}, func(), error) {
+		built++
+		calls = append(calls, "open db")
+		return "db", func() { calls = append(calls, "close db") }, nil
+	})
+	c.Provide("tx", func(ctx context.Context) (interface{}, func(), error) {
+		db, err := Resolve(ctx, "db")
+		if err != nil {
+			return nil, nil, err
+		}
+		calls = append(calls, "begin")
+		return db.(string) + " tx", func() { calls = append(calls, "rollback") }, nil
+	})
+	c.Provide("unused", func(ctx context.Context) (interface{}, func(), error) {
+		t.Error("unused provider called")
+		return nil, nil, nil
+	})
+	c.Provide("failing", func(ctx context.Context) (interface{}, func(), error) {
+		return nil, nil, errors.New("failed")
+	})
+	var saved context.Context
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		saved = ctx
+		tx, err := Resolve(ctx, "tx")
+		assert.NoError(t, err)
+		assert.Equal(t, "db tx", tx)
+		db, err := Resolve(ctx, "db")
+		assert.NoError(t, err)
+		assert.Equal(t, "db", db)
+		_, err = Resolve(ctx, "failing")
+		assert.EqualError(t, err, "failed")
+		_, err = Resolve(ctx, "missing")
+		assert.True(t, errors.Is(err, ErrNoProvider))
+		calls = append(calls, "handler")
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, 1, built)
+	assert.Equal(t, []string{"open db", "begin", "handler", "rollback", "close db"}, calls)
+
+	_, err := Resolve(saved, "unused")
+	assert.Equal(t, ErrContainerClosed, err)
+	_, err = Resolve(context.Background(), "db")
+	assert.True(t, errors.Is(err, ErrNoProvider))
+
+	// Each request gets its own instances
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, 2, built)
+}
+
+func TestContainerPanic(t *testing.T) {
+	disposed := false
+	c := Chain{}
+	c.Provide("res", func(ctx context.Context) (interface{}, func(), error) {
+		return 1, func() { disposed = true }, nil
+	})
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		Resolve(ctx, "res")
+		panic("boom")
+	})
+	assert.Panics(t, func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	})
+	assert.True(t, disposed)
+}
+
+func TestContainerProviderPanic(t *testing.T) {
+	var pctx context.Context
+	c := Chain{}
+	c.Provide("res", func(ctx context.Context) (interface{}, func(), error) {
+		pctx = ctx
+		panic("boom")
+	})
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		assert.PanicsWithValue(t, "boom", func() { Resolve(ctx, "res") })
+		v, err := Resolve(ctx, "res")
+		assert.Nil(t, v)
+		assert.EqualError(t, err, "xhandler: provider for res panicked: boom")
+		assert.NoError(t, pctx.Err())
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, context.Canceled, pctx.Err(), "released when the request ends")
+}
+
+func TestContainerProviderContext(t *testing.T) {
+	c := Chain{}
+	c.Provide("tx", func(ctx context.Context) (interface{}, func(), error) {
+		return ctx, nil, nil
+	})
+	var tx context.Context
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		sub, cancel := context.WithTimeout(context.WithValue(ctx, contextKey, "value"), time.Millisecond)
+		defer cancel()
+		v, _ := Resolve(sub, "tx")
+		tx = v.(context.Context)
+		<-sub.Done()
+
+		v, err := Resolve(ctx, "tx")
+		assert.NoError(t, err)
+		assert.Equal(t, tx, v, "same instance")
+		assert.NoError(t, tx.Err(), "not canceled with the first user ctx")
+		assert.Equal(t, "value", tx.Value(contextKey))
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, context.Canceled, tx.Err(), "canceled when the request ends")
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package xhandler
+
+import (
+	"time"
+)
+
+// processCPUTime is not supported on this platform.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,135 @@
+package xhandler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"context"
+)
+
+// ErrInvalidDeadline is returned by ParseDeadline when the value has none of
+// the supported formats.
+var ErrInvalidDeadline = errors.New("xhandler: invalid deadline")
+
+// ParseDeadline parses a deadline header value relative to now. Supported
+// formats are:
+//
+//  - a gRPC timeout: up to 8 digits followed by a unit among H (hours), M
+//    (minutes), S (seconds), m (milliseconds), u (microseconds) and n
+//    (nanoseconds), e.g. "1500m";
+//  - an absolute RFC 3339 timestamp, e.g. "2020-01-01T12:00:00.5Z";
+//  - an absolute Unix timestamp in seconds (with an optional fraction),
+//    milliseconds or microseconds, e.g. "1577880000.5".
+func ParseDeadline(v string, now time.Time) (time.Time, error) {
+	if d, ok := parseGRPCTimeout(v); ok {
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+		return unixTimestamp(f), nil
+	}
+	return time.Time{}, ErrInvalidDeadline
+}
+
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	n := int64(0)
+	for _, c := range v[:len(v)-1] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if n > math.MaxInt64/int64(unit) {
+		// Up to 99999999H, saturate instead of overflowing
+		return math.MaxInt64, true
+	}
+	return time.Duration(n) * unit, true
+}
+
+// DeadlineOptions configures DeadlineHandler.
+type DeadlineOptions struct {
+	// Header is the request header carrying the deadline. Defaults to
+	// grpc-timeout.
+	Header string
+	// Parse parses the header value. Defaults to ParseDeadline.
+	Parse func(v string, now time.Time) (time.Time, error)
+	// Max is the maximum time given to a request, whatever the header says.
+	// Zero means no limit.
+	Max time.Duration
+	// Default is the time given to requests without a valid header. Zero
+	// means no deadline is set.
+	Default time.Duration
+	// MinRemaining is the budget under which requests are rejected instead
+	// of being served, as they would not complete in time anyway. Requests
+	// whose deadline already passed are always rejected.
+	MinRemaining time.Duration
+}
+
+// DeadlineHandler returns a handler applying the deadline sent by the caller
+// in a request header to the request context, clamped to Max. Requests whose
+// budget is exhausted get a 504 Gateway Timeout response without being
+// served. Invalid headers are ignored.
+//
+// Unlike TimeoutHandler, the deadline follows the remaining budget of the
+// upstream, so the whole call graph gives up at the same time.
+func DeadlineHandler(o DeadlineOptions) func(next HandlerC) HandlerC {
+	if o.Header == "" {
+		o.Header = "grpc-timeout"
+	}
+	if o.Parse == nil {
+		o.Parse = ParseDeadline
+	}
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			var deadline time.Time
+			if v := r.Header.Get(o.Header); v != "" {
+				if d, err := o.Parse(v, now); err == nil {
+					deadline = d
+				}
+			}
+			if deadline.IsZero() && o.Default > 0 {
+				deadline = now.Add(o.Default)
+			}
+			if o.Max > 0 && (deadline.IsZero() || deadline.Sub(now) > o.Max) {
+				deadline = now.Add(o.Max)
+			}
+			if deadline.IsZero() {
+				next.ServeHTTPC(ctx, w, r)
+				return
+			}
+			if remaining := deadline.Sub(now); remaining <= 0 || remaining < o.MinRemaining {
+				http.Error(w, "Deadline exceeded", http.StatusGatewayTimeout)
+				return
+			}
+			ctx, cancel := context.WithDeadline(ctx, deadline)
+			defer cancel()
+			next.ServeHTTPC(ctx, w, r)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package xhandler
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeadline(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for v, want := range map[string]time.Time{
+		"1H":                        now.Add(time.Hour),
+		"2M":                        now.Add(2 * time.Minute),
+		"30S":                       now.Add(30 * time.Second),
+		"1500m":                     now.Add(1500 * time.Millisecond),
+		"99999999u":                 now.Add(99999999 * time.Microsecond),
+		"0n":                        now,
+		"2020-01-01T12:00:05.5Z":    now.Add(5500 * time.Millisecond),
+		"2020-01-01T13:00:01+01:00": now.Add(time.Second),
+		"1577880002.25":             now.Add(2250 * time.Millisecond),
+		"1577880003000":             now.Add(3 * time.Second),
+		"99999999H":                 now.Add(math.MaxInt64),
+	} {
+		got, err := ParseDeadline(v, now)
+		if assert.NoError(t, err, v) {
+			assert.True(t, want.Equal(got), "%s: want %s, got %s", v, want, got)
+		}
+	}
+	for _, v := range []string{"", "123456789S", "1s", "-1S", "1.5S", "S", "tomorrow", "-1577880000"} {
+		_, err := ParseDeadline(v, now)
+		assert.Equal(t, ErrInvalidDeadline, err, v)
+	}
+}
+
+func TestDeadlineHandler(t *testing.T) {
+	var remaining time.Duration
+	var hasDeadline, called bool
+	next := HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		called = true
+		var deadline time.Time
+		deadline, hasDeadline = ctx.Deadline()
+		remaining = time.Until(deadline)
+	})
+	serve := func(o DeadlineOptions, header, value string) int {
+		called, hasDeadline, remaining = false, false, 0
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if value != "" {
+			r.Header.Set(header, value)
+		}
+		DeadlineHandler(o)(next).ServeHTTPC(context.Background(), w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(DeadlineOptions{}, "grpc-timeout", ""))
+	assert.False(t, hasDeadline)
+
+	assert.Equal(t, http.StatusOK, serve(DeadlineOptions{}, "grpc-timeout", "500m"))
+	assert.True(t, hasDeadline)
+	assert.InDelta(t, 500*time.Millisecond, remaining, float64(50*time.Millisecond))
+
+	// Clamped to Max
+	assert.Equal(t, http.StatusOK, serve(DeadlineOptions{Max: time.Second}, "grpc-timeout", "1H"))
+	assert.InDelta(t, time.Second, remaining, float64(50*time.Millisecond))
+	assert.Equal(t, http.StatusOK, serve(DeadlineOptions{Max: time.Second}, "grpc-timeout", ""))
+	assert.InDelta(t, time.Second, remaining, float64(50*time.Millisecond))
+	assert.Equal(t, http.StatusOK, serve(DeadlineOptions{Max: time.Second}, "grpc-timeout", "99999999H"))
+	assert.InDelta(t, time.Second, remaining, float64(50*time.Millisecond))
+	assert.Equal(t, http.StatusOK, serve(DeadlineOptions{}, "grpc-timeout", "99999999H"))
+	assert.True(t, remaining > 100*365*24*time.Hour)
+
+	// Default on missing or invalid header
+	o := DeadlineOptions{Header: "X-Deadline", Default: 2 * time.Second}
+	assert.Equal(t, http.StatusOK, serve(o, "X-Deadline", "garbage"))
+	assert.InDelta(t, 2*time.Second, remaining, float64(50*time.Millisecond))
+	deadline := time.Now().Add(300 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	assert.Equal(t, http.StatusOK, serve(o, "X-Deadline", deadline))
+	assert.InDelta(t, 300*time.Millisecond, remaining, float64(50*time.Millisecond))
+
+	// Exhausted budgets
+	past := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	assert.Equal(t, http.StatusGatewayTimeout, serve(o, "X-Deadline", past))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusGatewayTimeout, serve(DeadlineOptions{}, "grpc-timeout", "0m"))
+	assert.Equal(t, http.StatusGatewayTimeout, serve(DeadlineOptions{MinRemaining: 100 * time.Millisecond}, "grpc-timeout", "50m"))
+	assert.False(t, called)
+}
@@ -0,0 +1,285 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// ErrDraining is reported by the readiness endpoint once the server started
+// shutting down.
+var ErrDraining = errors.New("server is shutting down")
+
+// HealthCheck checks a dependency or an internal state of the service. It
+// must return before ctx is done.
+type HealthCheck interface {
+	Check(ctx context.Context) error
+}
+
+// HealthCheckFunc is an adapter to allow the use of ordinary functions as
+// HealthCheck.
+type HealthCheckFunc func(ctx context.Context) error
+
+// Check calls f(ctx).
+func (f HealthCheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// CheckResult is the result of a single health check.
+type CheckResult struct {
+	Status   string
+	Error    string
+	Duration time.Duration
+}
+
+// MarshalJSON implements json.Marshaler, rendering the duration in a human
+// readable form.
+func (r CheckResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Status   string `json:"status"`
+		Error    string `json:"error,omitempty"`
+		Duration string `json:"duration"`
+	}{r.Status, r.Error, r.Duration.String()})
+}
+
+// HealthReport is the aggregated result of a set of health checks.
+type HealthReport struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]CheckResult `json:"checks,omitempty"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+// OK tells if all the checks passed.
+func (r HealthReport) OK() bool {
+	return r.Status == "ok"
+}
+
+// Health aggregates liveness and readiness checks and serves them on
+// endpoints suitable for Kubernetes probes. Probes get a plain 200 "ok" or
+// 503 response while a detailed JSON report is served when the verbose
+// query parameter is set (e.g. /readyz?verbose).
+//
+// When Server is set, readiness fails as soon as the server starts
+// draining so the instance is removed from load balancing (see
+// Server.DrainDelay).
+type Health struct {
+	// Timeout is the maximum duration of each check. Defaults to 2s. A
+	// probe whose deadline is shorter gets a failed report when it
+	// expires, the checks go on for the next probes.
+	Timeout time.Duration
+	// CacheTTL is how long results are reused before checks are run again,
+	// so frequent probes don't hammer dependencies. While checks run,
+	// concurrent probes get the previous results, or wait for the running
+	// checks if there are none. Defaults to 1s.
+	CacheTTL time.Duration
+	// Server, if set, makes readiness fail once the server is draining.
+	Server *Server
+
+	liveness  healthChecks
+	readiness healthChecks
+}
+
+type healthChecks struct {
+	mu     sync.Mutex
+	names  []string
+	checks map[string]HealthCheck
+	last   HealthReport
+	// gen is incremented when checks are added, so the reports of the
+	// checks started before are dropped
+	gen int
+	// pending is the run in progress, shared by concurrent reads
+	pending *healthRun
+}
+
+// healthRun is a run of the checks shared by concurrent reads.
+type healthRun struct {
+	gen    int
+	names  []string
+	done   chan struct{}
+	report HealthReport
+}
+
+// AddLiveness adds a check telling if the process is healthy. Failing
+// liveness checks get the process restarted, so only check internal state
+// here, not dependencies.
+func (h *Health) AddLiveness(name string, c HealthCheck) {
+	h.liveness.add(name, c)
+}
+
+// AddReadiness adds a check telling if the service can handle traffic,
+// like the availability of its dependencies.
+func (h *Health) AddReadiness(name string, c HealthCheck) {
+	h.readiness.add(name, c)
+}
+
+func (hc *healthChecks) add(name string, c HealthCheck) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.checks == nil {
+		hc.checks = map[string]HealthCheck{}
+	}
+	if _, found := hc.checks[name]; !found {
+		hc.names = append(hc.names, name)
+		sort.Strings(hc.names)
+	}
+	hc.checks[name] = c
+	hc.last = HealthReport{}
+	hc.gen++
+}
+
+// run returns the cached report or runs all checks concurrently, once for
+// all the concurrent reads.
+func (hc *healthChecks) run(ctx context.Context, timeout, ttl time.Duration) HealthReport {
+	hc.mu.Lock()
+	if !hc.last.CheckedAt.IsZero() && (hc.pending != nil || time.Since(hc.last.CheckedAt) < ttl) {
+		defer hc.mu.Unlock()
+		return hc.last
+	}
+	run := hc.pending
+	if run == nil || run.gen != hc.gen {
+		run = &healthRun{gen: hc.gen, names: append([]string(nil), hc.names...), done: make(chan struct{})}
+		checks := make([]HealthCheck, len(run.names))
+		for i, name := range run.names {
+			checks[i] = hc.checks[name]
+		}
+		hc.pending = run
+		// The checks are not tied to the request which happens to start
+		// them, others may wait for the report
+		go hc.check(context.WithoutCancel(ctx), run, checks, timeout)
+	}
+	hc.mu.Unlock()
+
+	select {
+	case <-run.done:
+		return run.report
+	case <-ctx.Done():
+		report := HealthReport{Status: "failed", Checks: map[string]CheckResult{}, CheckedAt: time.Now()}
+		for _, name := range run.names {
+			report.Checks[name] = CheckResult{Status: "failed", Error: ctx.Err().Error()}
+		}
+		return report
+	}
+}
+
+// check runs the checks of run and caches its report.
+func (hc *healthChecks) check(ctx context.Context, run *healthRun, checks []HealthCheck, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int, c HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := runCheck(ctx, c)
+			results[i] = CheckResult{Status: "ok", Duration: time.Since(start)}
+			if err != nil {
+				results[i].Status = "failed"
+				results[i].Error = err.Error()
+			}
+		}(i, checks[i])
+	}
+	wg.Wait()
+	report := HealthReport{Status: "ok", Checks: map[string]CheckResult{}, CheckedAt: time.Now()}
+	for i, name := range run.names {
+		report.Checks[name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "failed"
+		}
+	}
+	run.report = report
+	hc.mu.Lock()
+	if hc.pending == run {
+		hc.pending = nil
+	}
+	if run.gen == hc.gen {
+		hc.last = report
+	}
+	hc.mu.Unlock()
+	close(run.done)
+}
+
+// runCheck runs c, returning the ctx error if the check does not obey its
+// deadline.
+func runCheck(ctx context.Context, c HealthCheck) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Check(ctx)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Health) timeouts() (time.Duration, time.Duration) {
+	timeout, ttl := h.Timeout, h.CacheTTL
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	return timeout, ttl
+}
+
+// Live runs (or returns the cached result of) the liveness checks.
+func (h *Health) Live(ctx context.Context) HealthReport {
+	timeout, ttl := h.timeouts()
+	return h.liveness.run(ctx, timeout, ttl)
+}
+
+// Ready runs (or returns the cached result of) the readiness checks. The
+// report is failed without running the checks if the server is draining.
+func (h *Health) Ready(ctx context.Context) HealthReport {
+	if h.Server != nil && h.Server.Draining() {
+		return HealthReport{
+			Status:    "failed",
+			Checks:    map[string]CheckResult{"server": {Status: "failed", Error: ErrDraining.Error()}},
+			CheckedAt: time.Now(),
+		}
+	}
+	timeout, ttl := h.timeouts()
+	return h.readiness.run(ctx, timeout, ttl)
+}
+
+// LivenessHandler returns the liveness probe endpoint.
+func (h *Health) LivenessHandler() HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, r, h.Live(ctx))
+	})
+}
+
+// ReadinessHandler returns the readiness probe endpoint.
+func (h *Health) ReadinessHandler() HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, r, h.Ready(ctx))
+	})
+}
+
+func writeHealthReport(w http.ResponseWriter, r *http.Request, report HealthReport) {
+	w.Header().Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(report.Status + "\n"))
+}
@@ -0,0 +1,124 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	h := &Health{Timeout: 20 * time.Millisecond, CacheTTL: time.Hour}
+	calls := 0
+	h.AddLiveness("loop", HealthCheckFunc(func(ctx context.Context) error {
+		calls++
+		return nil
+	}))
+	h.AddReadiness("db", HealthCheckFunc(func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}))
+	h.AddReadiness("slow", HealthCheckFunc(func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}))
+
+	w := httptest.NewRecorder()
+	h.LivenessHandler().ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok\n", w.Body.String())
+	h.LivenessHandler().ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Equal(t, 1, calls, "results are cached")
+
+	w = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/readyz?verbose", nil)
+	start := time.Now()
+	h.ReadinessHandler().ServeHTTPC(context.Background(), w, r)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "checks are bounded by the timeout")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var report map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "failed", report["status"])
+	checks := report["checks"].(map[string]interface{})
+	assert.Equal(t, "connection refused", checks["db"].(map[string]interface{})["error"])
+	assert.Equal(t, context.DeadlineExceeded.Error(), checks["slow"].(map[string]interface{})["error"])
+}
+
+func TestHealthSlowCheck(t *testing.T) {
+	h := &Health{Timeout: time.Second, CacheTTL: time.Nanosecond}
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow := false
+	h.AddReadiness("db", HealthCheckFunc(func(ctx context.Context) error {
+		if slow {
+			started <- struct{}{}
+			<-block
+		}
+		return nil
+	}))
+	assert.True(t, h.Ready(context.Background()).OK())
+
+	slow = true
+	done := make(chan struct{})
+	go func() {
+		h.Ready(context.Background())
+		close(done)
+	}()
+	<-started
+	start := time.Now()
+	assert.True(t, h.Ready(context.Background()).OK(), "last report served while checks run")
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	close(block)
+	<-done
+}
+
+func TestHealthConcurrentChecks(t *testing.T) {
+	h := &Health{Timeout: time.Second, CacheTTL: time.Hour}
+	block := make(chan struct{})
+	started := make(chan struct{}, 10)
+	h.AddReadiness("db", HealthCheckFunc(func(ctx context.Context) error {
+		started <- struct{}{}
+		<-block
+		return nil
+	}))
+	reports := make(chan HealthReport, 1)
+	go func() { reports <- h.Ready(context.Background()) }()
+	<-started
+
+	// Without report yet, probes wait for the running checks and the
+	// ones going away do not fail the others
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report := h.Ready(ctx)
+	assert.False(t, report.OK())
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["db"].Error)
+	assert.Len(t, started, 0, "checks run once for concurrent probes")
+
+	// Checks added while running are not reported as passed
+	h.AddReadiness("cache", HealthCheckFunc(func(ctx context.Context) error {
+		return errors.New("unavailable")
+	}))
+	close(block)
+	assert.True(t, (<-reports).OK())
+	report = h.Ready(context.Background())
+	assert.False(t, report.OK())
+	assert.Equal(t, "unavailable", report.Checks["cache"].Error)
+}
+
+func TestHealthDraining(t *testing.T) {
+	s := NewServer("", Chain{}, HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {}))
+	h := &Health{Server: s}
+	assert.True(t, h.Ready(context.Background()).OK())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	w := httptest.NewRecorder()
+	h.ReadinessHandler().ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.True(t, h.Live(context.Background()).OK(), "liveness is not affected by draining")
+}
@@ -0,0 +1,222 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"context"
+)
+
+// ErrRequestCanceled is the cause of the context of a request canceled
+// through InFlight.Cancel.
+var ErrRequestCanceled = errors.New("xhandler: request canceled by an operator")
+
+// InFlightRequest describes a request being served.
+type InFlightRequest struct {
+	ID         string        `json:"id"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	RemoteAddr string        `json:"remote_addr"`
+	Start      time.Time     `json:"start"`
+	Age        time.Duration `json:"age"`
+	// Stage is the name of the chain stage currently running, if the
+	// InFlight Hook is used with Chain.Instrument.
+	Stage string `json:"stage,omitempty"`
+}
+
+type inflightEntry struct {
+	req    InFlightRequest
+	stage  atomic.Value
+	cancel context.CancelCauseFunc
+}
+
+// InFlight keeps track of the requests being served. Its Handler method
+// registers each request and the InFlight itself is a HandlerC serving an
+// admin page listing them (as JSON, or HTML for browsers) and canceling a
+// request's context with a POST request with a cancel=<id> form value.
+// Cross-origin POST requests from browsers are rejected.
+//
+// Make sure the admin endpoint is not exposed publicly. The zero value is
+// ready to use.
+type InFlight struct {
+	// RequestID returns the ID of a request. If nil, the ID stored by
+	// RequestIDHandler is used if any, sequential IDs otherwise.
+	RequestID func(ctx context.Context, r *http.Request) string
+
+	seq  uint64
+	mu   sync.RWMutex
+	reqs map[string]*inflightEntry
+}
+
+// NewInFlight creates an empty in-flight request registry.
+func NewInFlight() *InFlight {
+	return &InFlight{reqs: map[string]*inflightEntry{}}
+}
+
+type inflightCtxKey struct{}
+
+// Handler implements the middleware registering requests for the duration
+// of their handling.
+func (f *InFlight) Handler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		var id string
+		if f.RequestID != nil {
+			id = f.RequestID(ctx, r)
+		} else {
+			id = RequestIDFromContext(ctx)
+		}
+		if id == "" {
+			id = strconv.FormatUint(atomic.AddUint64(&f.seq, 1), 10)
+		}
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		e := &inflightEntry{
+			req: InFlightRequest{
+				ID:         id,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				RemoteAddr: r.RemoteAddr,
+				Start:      time.Now(),
+			},
+			cancel: cancel,
+		}
+		e.stage.Store("")
+		f.mu.Lock()
+		if f.reqs == nil {
+			f.reqs = map[string]*inflightEntry{}
+		}
+		if _, dup := f.reqs[id]; dup {
+			// Do not let a client provided duplicate ID hide another request
+			id += "-" + strconv.FormatUint(atomic.AddUint64(&f.seq, 1), 10)
+			e.req.ID = id
+		}
+		f.reqs[id] = e
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			delete(f.reqs, id)
+			f.mu.Unlock()
+		}()
+		next.ServeHTTPC(context.WithValue(ctx, inflightCtxKey{}, e), w, r)
+	})
+}
+
+// Hook is a StageHook keeping track of the chain stage each request is
+// running.
+func (f *InFlight) Hook(s Stage, h HandlerC) HandlerC {
+	name := s.String()
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if e, ok := ctx.Value(inflightCtxKey{}).(*inflightEntry); ok {
+			prev := e.stage.Load()
+			e.stage.Store(name)
+			defer e.stage.Store(prev)
+		}
+		h.ServeHTTPC(ctx, w, r)
+	})
+}
+
+// List returns the requests being served, oldest first.
+func (f *InFlight) List() []InFlightRequest {
+	now := time.Now()
+	f.mu.RLock()
+	list := make([]InFlightRequest, 0, len(f.reqs))
+	for _, e := range f.reqs {
+		req := e.req
+		req.Age = now.Sub(req.Start)
+		req.Stage = e.stage.Load().(string)
+		list = append(list, req)
+	}
+	f.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+	return list
+}
+
+// Cancel cancels the context of the request with the given ID with
+// ErrRequestCanceled as cause. It returns false if no such request is in
+// flight.
+func (f *InFlight) Cancel(id string) bool {
+	f.mu.RLock()
+	e, found := f.reqs[id]
+	f.mu.RUnlock()
+	if found {
+		e.cancel(ErrRequestCanceled)
+	}
+	return found
+}
+
+var inflightTemplate = template.Must(template.New("inflight").Parse(`<!DOCTYPE html>
+<html><head><title>In-flight requests</title></head><body>
+<h1>{{len .}} in-flight requests</h1>
+<table>
+<tr><th>ID</th><th>Age</th><th>Method</th><th>Path</th><th>Remote</th><th>Stage</th><th></th></tr>
+{{range .}}<tr><td>{{.ID}}</td><td>{{.Age}}</td><td>{{.Method}}</td><td>{{.Path}}</td><td>{{.RemoteAddr}}</td><td>{{.Stage}}</td>
+<td><form method="post"><input type="hidden" name="cancel" value="{{.ID}}"><button>Cancel</button></form></td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// ServeHTTPC implements HandlerC, serving the admin endpoint.
+func (f *InFlight) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if crossOrigin(r) {
+			http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		id := r.FormValue("cancel")
+		if !f.Cancel(id) {
+			http.Error(w, "Request not found", http.StatusNotFound)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	list := f.List()
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		inflightTemplate.Execute(w, list)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(list)
+}
+
+// crossOrigin tells if r was sent by a browser from another origin, so that
+// admin endpoints changing state can't be triggered by a forged form on a
+// page visited by an operator. Requests from non-browser clients, which
+// send neither Sec-Fetch-Site nor Origin, are allowed.
+func crossOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
@@ -0,0 +1,124 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlight(t *testing.T) {
+	f := &InFlight{}
+	started := make(chan struct{})
+	done := make(chan error)
+	served := make(chan struct{})
+	c := Chain{}
+	c.UseC(f.Handler)
+	c.UseC(CloseHandler)
+	h := c.Instrument(f.Hook).HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-ctx.Done()
+		done <- context.Cause(ctx)
+	})
+	go func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+		close(served)
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	f.ServeHTTPC(context.Background(), w, testRequest)
+	var list []InFlightRequest
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "1", list[0].ID)
+		assert.Equal(t, "GET", list[0].Method)
+		assert.Equal(t, "/", list[0].Path)
+		assert.Equal(t, "2:xhandler.TestInFlight.func1", list[0].Stage)
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	f.ServeHTTPC(context.Background(), w, r)
+	assert.Contains(t, w.Body.String(), `<td>1</td>`)
+
+	r, _ = http.NewRequest("POST", "/", strings.NewReader(url.Values{"cancel": {"2"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	f.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Forged requests from other sites are rejected
+	r, _ = http.NewRequest("POST", "http://admin.local/?cancel=1", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	f.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	r.Header.Del("Origin")
+	r.Header.Set("Sec-Fetch-Site", "cross-site")
+	w = httptest.NewRecorder()
+	f.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Len(t, f.List(), 1)
+
+	r, _ = http.NewRequest("POST", "http://admin.local/?cancel=1", nil)
+	r.Header.Set("Origin", "http://admin.local")
+	w = httptest.NewRecorder()
+	f.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrRequestCanceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("request not canceled")
+	}
+	<-served
+	assert.Empty(t, f.List())
+}
+
+func TestInFlightOrder(t *testing.T) {
+	f := NewInFlight()
+	f.RequestID = func(ctx context.Context, r *http.Request) string {
+		return "same"
+	}
+	var list []InFlightRequest
+	h := f.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/outer" {
+			time.Sleep(time.Millisecond)
+			r, _ := http.NewRequest("GET", "/inner", nil)
+			f.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				list = f.List()
+			})).ServeHTTPC(ctx, w, r)
+		}
+	}))
+	r, _ := http.NewRequest("GET", "/outer", nil)
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "/outer", list[0].Path)
+		assert.Equal(t, "same", list[0].ID)
+		assert.Equal(t, "/inner", list[1].Path)
+		assert.NotEqual(t, "same", list[1].ID, "duplicate IDs are made unique")
+	}
+}
+
+func TestInFlightRequestIDFromContext(t *testing.T) {
+	f := NewInFlight()
+	var list []InFlightRequest
+	h := RequestIDHandler(RequestIDOptions{})(f.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		list = f.List()
+	})))
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-Id", "abc-123")
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "abc-123", list[0].ID)
+	}
+}
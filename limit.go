@@ -0,0 +1,289 @@
+package xhandler
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"context"
+)
+
+var (
+	// ErrQueueFull is returned by ConcurrencyLimiter.Acquire when the wait
+	// queue is full.
+	ErrQueueFull = errors.New("xhandler: concurrency limiter queue is full")
+	// ErrQueueTimeout is returned by ConcurrencyLimiter.Acquire when the
+	// maximum wait time expired.
+	ErrQueueTimeout = errors.New("xhandler: concurrency limiter wait timed out")
+)
+
+// ConcurrencyOptions configures a ConcurrencyLimiter.
+type ConcurrencyOptions struct {
+	// Name identifies the limiter in metrics.
+	Name string
+	// Limit is the maximum number of concurrent requests per key.
+	Limit int
+	// QueueSize is the maximum number of requests waiting for a slot per
+	// key. Requests beyond are rejected immediately.
+	QueueSize int
+	// MaxWait is the maximum time a request may wait in the queue. The
+	// request context deadline is always honored. Zero means no limit.
+	MaxWait time.Duration
+	// Key returns the key requests are limited by, like the route or the
+	// tenant. If nil, all requests share the same limit.
+	Key func(ctx context.Context, r *http.Request) string
+	// RetryAfter is the delay advertised in the Retry-After header of
+	// rejected requests. Defaults to 1s.
+	RetryAfter time.Duration
+	// Registry, if set, receives the limiter metrics: in-flight and queued
+	// gauges, wait time histogram and rejection counter.
+	Registry *Registry
+	// KeyLabel sets the key label of the metrics to the request key. By
+	// default it is empty and the metrics cover all keys. Each key gets its
+	// own series, bound their number with Registry.MaxSeries if keys come
+	// from requests, like tenants.
+	KeyLabel bool
+}
+
+// ConcurrencyLimiter caps the number of concurrent requests, per key,
+// queuing the excess in a bounded FIFO queue. Waiting requests leave the
+// queue when their context is done (deadline or client disconnect).
+type ConcurrencyLimiter struct {
+	o     ConcurrencyOptions
+	mu    sync.Mutex
+	limit int
+	keys  map[string]*limiterKey
+
+	// Totals of all keys, reported unless the metrics are labelled by key
+	totalInflight int
+	totalQueued   int
+
+	inflight *GaugeVec
+	queued   *GaugeVec
+	wait     *HistogramVec
+	rejected *CounterVec
+}
+
+type limiterKey struct {
+	inflight int
+	waiters  *list.List // of chan struct{}
+	// Counts last added to the totals of the limiter
+	observedInflight int
+	observedQueued   int
+}
+
+// NewConcurrencyLimiter creates a concurrency limiter.
+func NewConcurrencyLimiter(o ConcurrencyOptions) *ConcurrencyLimiter {
+	if o.Limit <= 0 {
+		panic("xhandler: concurrency limit must be positive")
+	}
+	if o.RetryAfter <= 0 {
+		o.RetryAfter = time.Second
+	}
+	l := &ConcurrencyLimiter{o: o, limit: o.Limit, keys: map[string]*limiterKey{}}
+	if o.Registry != nil {
+		l.inflight = o.Registry.Gauge("concurrency_limiter_in_flight",
+			"Number of requests holding a concurrency slot.", "limiter", "key")
+		l.queued = o.Registry.Gauge("concurrency_limiter_queued",
+			"Number of requests waiting for a concurrency slot.", "limiter", "key")
+		l.wait = o.Registry.Histogram("concurrency_limiter_wait_seconds",
+			"Time spent waiting for a concurrency slot.", nil, "limiter", "key")
+		l.rejected = o.Registry.Counter("concurrency_limiter_rejected_total",
+			"Number of requests rejected by the concurrency limiter.", "limiter", "key", "reason")
+	}
+	return l
+}
+
+// Limit returns the current concurrency limit.
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// SetLimit changes the concurrency limit. Waiting requests are admitted
+// right away if the limit is raised; if lowered, in-flight requests are
+// not interrupted.
+func (l *ConcurrencyLimiter) SetLimit(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	for key, k := range l.keys {
+		for k.inflight < l.limit && k.waiters.Len() > 0 {
+			l.handOff(key, k)
+		}
+	}
+}
+
+// Stats returns the number of in-flight and queued requests for key.
+func (l *ConcurrencyLimiter) Stats(key string) (inflight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if k, found := l.keys[key]; found {
+		return k.inflight, k.waiters.Len()
+	}
+	return 0, 0
+}
+
+// Acquire waits for a slot for key, in FIFO order. It returns the function
+// to call to release the slot, or an error if the queue is full, the
+// maximum wait time expired or ctx is done.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (release func(), err error) {
+	l.mu.Lock()
+	k, found := l.keys[key]
+	if !found {
+		k = &limiterKey{waiters: list.New()}
+		l.keys[key] = k
+	}
+	if k.inflight < l.limit && k.waiters.Len() == 0 {
+		k.inflight++
+		l.observe(key, k)
+		l.mu.Unlock()
+		return l.releaser(key), nil
+	}
+	if k.waiters.Len() >= l.o.QueueSize {
+		l.mu.Unlock()
+		l.reject(key, "queue_full")
+		return nil, ErrQueueFull
+	}
+	ready := make(chan struct{})
+	e := k.waiters.PushBack(ready)
+	l.observe(key, k)
+	l.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if l.o.MaxWait > 0 {
+		t := time.NewTimer(l.o.MaxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ready:
+		if l.wait != nil {
+			l.wait.With(l.o.Name, l.keyLabel(key)).Observe(time.Since(start).Seconds())
+		}
+		return l.releaser(key), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+	l.mu.Lock()
+	select {
+	case <-ready:
+		// A slot was handed to us meanwhile, pass it on
+		l.mu.Unlock()
+		l.releaser(key)()
+	default:
+		k.waiters.Remove(e)
+		l.observe(key, k)
+		l.cleanup(key, k)
+		l.mu.Unlock()
+	}
+	if err == ErrQueueTimeout {
+		l.reject(key, "timeout")
+	} else {
+		l.reject(key, "canceled")
+	}
+	return nil, err
+}
+
+func (l *ConcurrencyLimiter) releaser(key string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			k := l.keys[key]
+			k.inflight--
+			if k.inflight < l.limit && k.waiters.Len() > 0 {
+				l.handOff(key, k)
+			}
+			l.observe(key, k)
+			l.cleanup(key, k)
+		})
+	}
+}
+
+// handOff gives a slot to the first waiter of k. Must be called with l.mu
+// held.
+func (l *ConcurrencyLimiter) handOff(key string, k *limiterKey) {
+	e := k.waiters.Front()
+	k.waiters.Remove(e)
+	k.inflight++
+	close(e.Value.(chan struct{}))
+	l.observe(key, k)
+}
+
+func (l *ConcurrencyLimiter) cleanup(key string, k *limiterKey) {
+	if k.inflight == 0 && k.waiters.Len() == 0 {
+		delete(l.keys, key)
+	}
+}
+
+// keyLabel returns the value of the key label of the metrics for key.
+func (l *ConcurrencyLimiter) keyLabel(key string) string {
+	if l.o.KeyLabel {
+		return key
+	}
+	return ""
+}
+
+// observe updates the gauges after the counts of k changed. Must be called
+// with l.mu held.
+func (l *ConcurrencyLimiter) observe(key string, k *limiterKey) {
+	if l.inflight == nil {
+		return
+	}
+	if l.o.KeyLabel {
+		l.inflight.With(l.o.Name, key).Set(float64(k.inflight))
+		l.queued.With(l.o.Name, key).Set(float64(k.waiters.Len()))
+		return
+	}
+	l.totalInflight += k.inflight - k.observedInflight
+	l.totalQueued += k.waiters.Len() - k.observedQueued
+	k.observedInflight, k.observedQueued = k.inflight, k.waiters.Len()
+	l.inflight.With(l.o.Name, "").Set(float64(l.totalInflight))
+	l.queued.With(l.o.Name, "").Set(float64(l.totalQueued))
+}
+
+func (l *ConcurrencyLimiter) reject(key, reason string) {
+	if l.rejected != nil {
+		l.rejected.With(l.o.Name, l.keyLabel(key), reason).Inc()
+	}
+}
+
+// Handler implements the middleware. Rejected requests get a 503 Service
+// Unavailable response with a Retry-After header.
+func (l *ConcurrencyLimiter) Handler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		key := ""
+		if l.o.Key != nil {
+			key = l.o.Key(ctx, r)
+		}
+		release, err := l.Acquire(ctx, key)
+		if err != nil {
+			w.Header().Set("Retry-After", retryAfter(l.o.RetryAfter))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		next.ServeHTTPC(ctx, w, r)
+	})
+}
+
+// retryAfter formats d as a Retry-After delay in seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	s := int64((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return strconv.FormatInt(s, 10)
+}
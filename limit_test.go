@@ -0,0 +1,152 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimiterFIFO(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1, QueueSize: 3})
+	release, err := l.Acquire(context.Background(), "")
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			release, err := l.Acquire(context.Background(), "")
+			if assert.NoError(t, err) {
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				release()
+			}
+		}(i)
+		// Make sure goroutines are queued in order
+		for {
+			if _, queued := l.Stats(""); queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	_, err = l.Acquire(context.Background(), "")
+	assert.Equal(t, ErrQueueFull, err)
+
+	release()
+	release()
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2}, order)
+	inflight, queued := l.Stats("")
+	assert.Equal(t, 0, inflight)
+	assert.Equal(t, 0, queued)
+	assert.Empty(t, l.keys)
+}
+
+func TestConcurrencyLimiterWaitCanceled(t *testing.T) {
+	reg := NewRegistry()
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Name: "api", Limit: 1, QueueSize: 10, MaxWait: 20 * time.Millisecond, Registry: reg, KeyLabel: true})
+	release, _ := l.Acquire(context.Background(), "k")
+	defer release()
+
+	_, err := l.Acquire(context.Background(), "k")
+	assert.Equal(t, ErrQueueTimeout, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(ctx, "k")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	_, queued := l.Stats("k")
+	assert.Equal(t, 0, queued)
+	rejected := reg.Counter("concurrency_limiter_rejected_total", "", "limiter", "key", "reason")
+	assert.Equal(t, 1.0, rejected.With("api", "k", "timeout").Value())
+	assert.Equal(t, 1.0, rejected.With("api", "k", "canceled").Value())
+	assert.Equal(t, 1.0, reg.Gauge("concurrency_limiter_in_flight", "", "limiter", "key").With("api", "k").Value())
+}
+
+func TestConcurrencyLimiterMetricsTotal(t *testing.T) {
+	reg := NewRegistry()
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Name: "api", Limit: 1, Registry: reg})
+	release1, _ := l.Acquire(context.Background(), "a")
+	release2, _ := l.Acquire(context.Background(), "b")
+	_, err := l.Acquire(context.Background(), "b")
+	assert.Equal(t, ErrQueueFull, err)
+
+	inflight := reg.Gauge("concurrency_limiter_in_flight", "", "limiter", "key")
+	assert.Equal(t, 2.0, inflight.With("api", "").Value(), "keys are not labelled by default")
+	assert.Equal(t, 0.0, inflight.With("api", "a").Value())
+	rejected := reg.Counter("concurrency_limiter_rejected_total", "", "limiter", "key", "reason")
+	assert.Equal(t, 1.0, rejected.With("api", "", "queue_full").Value())
+	release1()
+	release2()
+	assert.Equal(t, 0.0, inflight.With("api", "").Value())
+}
+
+func TestConcurrencyLimiterSetLimit(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{Limit: 1, QueueSize: 1})
+	release, _ := l.Acquire(context.Background(), "")
+	defer release()
+	acquired := make(chan struct{})
+	go func() {
+		release, err := l.Acquire(context.Background(), "")
+		if assert.NoError(t, err) {
+			close(acquired)
+			release()
+		}
+	}()
+	for {
+		if _, queued := l.Stats(""); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	l.SetLimit(2)
+	assert.Equal(t, 2, l.Limit())
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("waiter not admitted after raising the limit")
+	}
+}
+
+func TestConcurrencyLimiterHandler(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyOptions{
+		Limit:      1,
+		RetryAfter: 1500 * time.Millisecond,
+		Key: func(ctx context.Context, r *http.Request) string {
+			return r.URL.Path
+		},
+	})
+	block := make(chan struct{})
+	started := make(chan struct{})
+	h := l.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-block
+		}
+	}))
+	r, _ := http.NewRequest("GET", "/slow", nil)
+	go h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	<-started
+
+	w := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, http.StatusOK, w.Code, "other keys are not limited")
+	close(block)
+}
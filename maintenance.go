@@ -0,0 +1,206 @@
+package xhandler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"context"
+)
+
+// MaintenanceStatus is the state of a Maintenance switch.
+type MaintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	// Until is the expected end of the maintenance, if known.
+	Until time.Time `json:"until"`
+}
+
+// Maintenance is a switch putting the requests it handles into maintenance:
+// while enabled, they get a 503 Service Unavailable response with a
+// Retry-After header, unless they match Bypass. The switch can be toggled
+// at runtime with Enable and Disable or through the admin endpoint served
+// by Maintenance itself.
+//
+// Use several switches, set on different routes or matching different
+// requests with Match, to put parts of a service into maintenance.
+type Maintenance struct {
+	// Match selects the requests subject to the switch. If nil, all
+	// requests are.
+	Match func(ctx context.Context, r *http.Request) bool
+	// Bypass lets matching requests through while in maintenance, like
+	// requests from internal IPs (see BypassCIDR) or carrying a signed
+	// header (see BypassSignedHeader).
+	Bypass func(ctx context.Context, r *http.Request) bool
+	// Page writes the maintenance response. The Retry-After header is
+	// already set and the status code is forced to 503 whatever the page
+	// sets, so it can still set its own headers. Defaults to a plain text
+	// page with the maintenance message.
+	Page HandlerC
+	// RetryAfter is the delay advertised when the end of the maintenance is
+	// unknown. Defaults to 60s.
+	RetryAfter time.Duration
+
+	status atomic.Value // MaintenanceStatus
+}
+
+// Enable starts the maintenance, with an optional message and expected end
+// time (zero if unknown). The maintenance is not automatically disabled once
+// until passed.
+func (m *Maintenance) Enable(message string, until time.Time) {
+	m.status.Store(MaintenanceStatus{Enabled: true, Message: message, Until: until})
+}
+
+// Disable ends the maintenance.
+func (m *Maintenance) Disable() {
+	m.status.Store(MaintenanceStatus{})
+}
+
+// Status returns the current state of the switch.
+func (m *Maintenance) Status() MaintenanceStatus {
+	s, _ := m.status.Load().(MaintenanceStatus)
+	return s
+}
+
+func (m *Maintenance) retryAfter(s MaintenanceStatus) time.Duration {
+	if d := time.Until(s.Until); d > 0 {
+		return d
+	}
+	if m.RetryAfter > 0 {
+		return m.RetryAfter
+	}
+	return time.Minute
+}
+
+// Handler implements the middleware.
+func (m *Maintenance) Handler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		s := m.Status()
+		if !s.Enabled ||
+			m.Match != nil && !m.Match(ctx, r) ||
+			m.Bypass != nil && m.Bypass(ctx, r) {
+			next.ServeHTTPC(ctx, w, r)
+			return
+		}
+		w.Header().Set("Retry-After", retryAfter(m.retryAfter(s)))
+		w.Header().Set("Cache-Control", "no-store")
+		if m.Page != nil {
+			pw := wrapWriter(w)
+			pw.ForceStatus(http.StatusServiceUnavailable)
+			m.Page.ServeHTTPC(ctx, pw, r)
+			pw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		msg := "Service under maintenance"
+		if s.Message != "" {
+			msg += ": " + s.Message
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	})
+}
+
+// ServeHTTPC implements HandlerC, serving the admin endpoint: GET returns the
+// status as JSON and POST changes it with the enabled, message and duration
+// (e.g. "30m", the expected length of the maintenance) form values.
+// Cross-origin POST requests from browsers are rejected.
+func (m *Maintenance) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if crossOrigin(r) {
+			http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid enabled value", http.StatusBadRequest)
+			return
+		}
+		if !enabled {
+			m.Disable()
+			break
+		}
+		var until time.Time
+		if v := r.FormValue("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid duration value", http.StatusBadRequest)
+				return
+			}
+			until = time.Now().Add(d)
+		}
+		m.Enable(r.FormValue("message"), until)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(m.Status())
+}
+
+// BypassCIDR returns a bypass matcher for requests coming from one of the
+// given networks (e.g. "10.0.0.0/8"), based on RemoteAddr. It panics if a
+// network is invalid.
+func BypassCIDR(cidrs ...string) func(ctx context.Context, r *http.Request) bool {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("xhandler: invalid bypass network: " + err.Error())
+		}
+		nets[i] = n
+	}
+	return func(ctx context.Context, r *http.Request) bool {
+		ip := net.ParseIP(KeyByIP(ctx, r))
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SignMaintenanceBypass returns a header value accepted by a
+// BypassSignedHeader matcher using the same secret until expires.
+func SignMaintenanceBypass(secret []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + bypassSignature(secret, exp)
+}
+
+// BypassSignedHeader returns a bypass matcher for requests carrying, in the
+// header name, an unexpired value generated by SignMaintenanceBypass with
+// secret.
+func BypassSignedHeader(name string, secret []byte) func(ctx context.Context, r *http.Request) bool {
+	return func(ctx context.Context, r *http.Request) bool {
+		exp, sig, found := strings.Cut(r.Header.Get(name), ".")
+		if !found {
+			return false
+		}
+		t, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil || time.Now().Unix() >= t {
+			return false
+		}
+		return hmac.Equal([]byte(sig), []byte(bypassSignature(secret, exp)))
+	}
+}
+
+func bypassSignature(secret []byte, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,160 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := &Maintenance{
+		Match: func(ctx context.Context, r *http.Request) bool {
+			return strings.HasPrefix(r.URL.Path, "/api/")
+		},
+		Bypass:     BypassCIDR("10.0.0.0/8"),
+		RetryAfter: 2 * time.Minute,
+	}
+	h := m.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	serve := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		h.ServeHTTPC(context.Background(), w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, serve("/api/users", "1.2.3.4:1234").Code)
+
+	m.Enable("database migration", time.Time{})
+	w := serve("/api/users", "1.2.3.4:1234")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "120", w.Header().Get("Retry-After"))
+	assert.Equal(t, "Service under maintenance: database migration\n", w.Body.String())
+	assert.Equal(t, http.StatusOK, serve("/api/users", "10.1.2.3:1234").Code)
+	assert.Equal(t, http.StatusOK, serve("/static/app.js", "1.2.3.4:1234").Code)
+
+	m.Enable("", time.Now().Add(10*time.Minute))
+	w = serve("/api/users", "1.2.3.4:1234")
+	assert.Equal(t, "600", w.Header().Get("Retry-After"))
+	assert.Equal(t, "Service under maintenance\n", w.Body.String())
+
+	m.Disable()
+	assert.Equal(t, http.StatusOK, serve("/api/users", "1.2.3.4:1234").Code)
+}
+
+func TestMaintenancePage(t *testing.T) {
+	m := &Maintenance{
+		Page: HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("<h1>Back soon</h1>"))
+			w.(http.Flusher).Flush()
+		}),
+	}
+	m.Enable("", time.Time{})
+	h := m.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, "<h1>Back soon</h1>", w.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	// A page writing nothing still gets the status
+	m.Page = HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {})
+	w = httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestMaintenanceAdmin(t *testing.T) {
+	m := &Maintenance{}
+	admin := func(method string, form url.Values) (*httptest.ResponseRecorder, MaintenanceStatus) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "/admin/maintenance", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		m.ServeHTTPC(context.Background(), w, r)
+		var s MaintenanceStatus
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return w, s
+	}
+	w, s := admin("GET", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, s.Enabled)
+
+	w, s = admin("POST", url.Values{"enabled": {"true"}, "message": {"upgrade"}, "duration": {"30m"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, s.Enabled)
+	assert.Equal(t, "upgrade", s.Message)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), s.Until, time.Second)
+	assert.True(t, s.Until.Equal(m.Status().Until))
+
+	w, _ = admin("POST", url.Values{"enabled": {"yes please"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = admin("POST", url.Values{"enabled": {"1"}, "duration": {"-5m"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, m.Status().Enabled)
+
+	w, s = admin("POST", url.Values{"enabled": {"false"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, s.Enabled)
+	assert.False(t, m.Status().Enabled)
+
+	// Forged requests from other sites are rejected
+	w = httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://admin.local/admin/maintenance?enabled=true", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	m.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, m.Status().Enabled)
+
+	w, _ = admin("DELETE", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestBypassSignedHeader(t *testing.T) {
+	secret := []byte("s3cr3t")
+	bypass := BypassSignedHeader("X-Maintenance-Bypass", secret)
+	check := func(v string) bool {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Maintenance-Bypass", v)
+		return bypass(context.Background(), r)
+	}
+	valid := SignMaintenanceBypass(secret, time.Now().Add(time.Hour))
+	assert.True(t, check(valid))
+	assert.False(t, check(""))
+	assert.False(t, check("garbage"))
+	assert.False(t, check(SignMaintenanceBypass([]byte("other"), time.Now().Add(time.Hour))))
+	assert.False(t, check(SignMaintenanceBypass(secret, time.Now().Add(-time.Second))))
+	// Tampering with the expiration invalidates the signature
+	_, sig, _ := strings.Cut(valid, ".")
+	assert.False(t, check(strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)+"."+sig))
+}
+
+func TestBypassCIDR(t *testing.T) {
+	bypass := BypassCIDR("10.0.0.0/8", "::1/128")
+	for addr, want := range map[string]bool{
+		"10.20.30.40:80": true,
+		"[::1]:80":       true,
+		"11.0.0.1:80":    false,
+		"invalid":        false,
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		assert.Equal(t, want, bypass(context.Background(), r), addr)
+	}
+	assert.Panics(t, func() { BypassCIDR("10.0.0.0") })
+}
@@ -0,0 +1,141 @@
+package xhandler
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// MetricsOptions configures MetricsHandler.
+type MetricsOptions struct {
+	// Namespace is prepended to all metric names (as namespace_name).
+	Namespace string
+	// Buckets are the latency histogram buckets in seconds. DefBuckets is
+	// used if nil.
+	Buckets []float64
+	// SizeBuckets are the response size histogram buckets in bytes.
+	// DefSizeBuckets is used if nil.
+	SizeBuckets []float64
+	// Route returns the route label of a request once it has been handled.
+	// Never return raw URL paths here as it would make the label
+	// cardinality unbounded. If nil, the route label is left empty.
+	Route func(ctx context.Context, r *http.Request) string
+	// MaxRoutes caps the number of distinct route label values. Requests
+	// with a route beyond that limit are reported with the "other" route.
+	// Zero means no limit.
+	MaxRoutes int
+}
+
+// MetricsHandler returns a handler recording RED metrics (requests, errors,
+// duration, in-flight requests and response size) into reg. Metrics are
+// labelled by method, status class (2xx, 4xx...) and route.
+//
+// Serve reg (which is a HandlerC) on a separate route to expose them.
+func MetricsHandler(reg *Registry, o MetricsOptions) func(next HandlerC) HandlerC {
+	name := func(n string) string {
+		if o.Namespace != "" {
+			return o.Namespace + "_" + n
+		}
+		return n
+	}
+	if o.SizeBuckets == nil {
+		o.SizeBuckets = DefSizeBuckets
+	}
+	requests := reg.Counter(name("http_requests_total"),
+		"Total number of HTTP requests.", "method", "code", "route")
+	errors := reg.Counter(name("http_request_errors_total"),
+		"Total number of HTTP requests answered with a 5xx status.", "method", "code", "route")
+	duration := reg.Histogram(name("http_request_duration_seconds"),
+		"HTTP request latency in seconds.", o.Buckets, "method", "code", "route")
+	size := reg.Histogram(name("http_response_size_bytes"),
+		"HTTP response body size in bytes.", o.SizeBuckets, "method", "code", "route")
+	inflight := reg.Gauge(name("http_requests_in_flight"),
+		"Number of HTTP requests currently being served.", "method")
+	routes := newLabelSet(o.MaxRoutes)
+
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			method := methodLabel(r.Method)
+			g := inflight.With(method)
+			g.Inc()
+			rw := wrapWriter(w)
+			defer rw.watchPanic(func(p *handlerPanic) {
+				g.Dec()
+				route := ""
+				if o.Route != nil {
+					route = routes.get(o.Route(ctx, r))
+				}
+				code := statusClass(rw.Status())
+				if p.failed() {
+					code = "5xx"
+				}
+				requests.With(method, code, route).Inc()
+				if code == "5xx" {
+					errors.With(method, code, route).Inc()
+				}
+				duration.With(method, code, route).Observe(time.Since(start).Seconds())
+				size.With(method, code, route).Observe(float64(rw.Size()))
+			})
+			next.ServeHTTPC(ctx, rw, r)
+		})
+	}
+}
+
+// statusClass returns the class of a status code as 2xx, 3xx... A request
+// for which nothing was written is reported as 2xx like net/http would.
+func statusClass(code int) string {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// methodLabel maps non standard methods to "other" to bound cardinality.
+func methodLabel(m string) string {
+	switch m {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE":
+		return m
+	}
+	return "other"
+}
+
+// labelSet bounds the number of distinct values a label can take.
+type labelSet struct {
+	max    int
+	mu     sync.RWMutex
+	values map[string]struct{}
+}
+
+func newLabelSet(max int) *labelSet {
+	return &labelSet{max: max, values: map[string]struct{}{}}
+}
+
+// get returns v if it is known or if there is still room for it, "other"
+// otherwise.
+func (s *labelSet) get(v string) string {
+	if s.max <= 0 {
+		return v
+	}
+	s.mu.RLock()
+	_, found := s.values[v]
+	s.mu.RUnlock()
+	if found {
+		return v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found = s.values[v]; !found {
+		if len(s.values) >= s.max {
+			return "other"
+		}
+		s.values[v] = struct{}{}
+	}
+	return v
+}
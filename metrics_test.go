@@ -0,0 +1,97 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	reg := NewRegistry()
+	mh := MetricsHandler(reg, MetricsOptions{
+		Namespace: "app",
+		Route: func(ctx context.Context, r *http.Request) string {
+			return r.URL.Path
+		},
+		MaxRoutes: 2,
+	})
+	h := mh(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	for _, p := range []string{"/a", "/a", "/fail", "/b"} {
+		r, _ := http.NewRequest("GET", p, nil)
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	}
+	r, _ := http.NewRequest("FOO", "/a", nil)
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	requests := reg.Counter("app_http_requests_total", "", "method", "code", "route")
+	assert.Equal(t, 2.0, requests.With("GET", "2xx", "/a").Value())
+	assert.Equal(t, 1.0, requests.With("GET", "5xx", "/fail").Value())
+	assert.Equal(t, 1.0, requests.With("GET", "2xx", "other").Value(), "routes beyond MaxRoutes are reported as other")
+	assert.Equal(t, 1.0, requests.With("other", "2xx", "/a").Value())
+	errors := reg.Counter("app_http_request_errors_total", "", "method", "code", "route")
+	assert.Equal(t, 1.0, errors.With("GET", "5xx", "/fail").Value())
+	size := reg.Histogram("app_http_response_size_bytes", "", nil, "method", "code", "route")
+	assert.Equal(t, 10.0, size.With("GET", "2xx", "/a").Sum())
+	duration := reg.Histogram("app_http_request_duration_seconds", "", nil, "method", "code", "route")
+	assert.Equal(t, uint64(2), duration.With("GET", "2xx", "/a").Count())
+	assert.Equal(t, 0.0, reg.Gauge("app_http_requests_in_flight", "", "method").With("GET").Value())
+}
+
+func TestMetricsHandlerPanic(t *testing.T) {
+	reg := NewRegistry()
+	h := MetricsHandler(reg, MetricsOptions{})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	r, _ := http.NewRequest("GET", "/", nil)
+	assert.PanicsWithValue(t, "boom", func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	})
+	requests := reg.Counter("http_requests_total", "", "method", "code", "route")
+	assert.Equal(t, 1.0, requests.With("GET", "5xx", "").Value())
+	assert.Equal(t, 0.0, requests.With("GET", "2xx", "").Value())
+	errors := reg.Counter("http_request_errors_total", "", "method", "code", "route")
+	assert.Equal(t, 1.0, errors.With("GET", "5xx", "").Value())
+	assert.Equal(t, 0.0, reg.Gauge("http_requests_in_flight", "", "method").With("GET").Value())
+}
+
+func TestMetricsHandlerAbort(t *testing.T) {
+	reg := NewRegistry()
+	h := MetricsHandler(reg, MetricsOptions{})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic(http.ErrAbortHandler)
+	}))
+	r, _ := http.NewRequest("GET", "/", nil)
+	assert.Panics(t, func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	})
+	requests := reg.Counter("http_requests_total", "", "method", "code", "route")
+	assert.Equal(t, 1.0, requests.With("GET", "2xx", "").Value())
+	assert.Equal(t, 0.0, requests.With("GET", "5xx", "").Value())
+}
+
+func TestMetricsHandlerInFlight(t *testing.T) {
+	reg := NewRegistry()
+	var inflight float64
+	h := MetricsHandler(reg, MetricsOptions{})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		inflight = reg.Gauge("http_requests_in_flight", "", "method").With("POST").Value()
+	}))
+	r, _ := http.NewRequest("POST", "/", nil)
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	assert.Equal(t, 1.0, inflight)
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(0))
+	assert.Equal(t, "3xx", statusClass(304))
+	assert.Equal(t, "other", statusClass(999))
+}
@@ -34,7 +34,8 @@ func CloseHandler(next HandlerC) HandlerC {
 // TimeoutHandler returns a Handler which adds a timeout to the context.
 //
 // Child handlers have the responsability of obeying the context deadline and to return
-// an appropriate error (or not) response in case of timeout.
+// an appropriate error (or not) response in case of timeout. See BudgetHandler for a
+// timeout reserving time to write this response.
 func TimeoutHandler(timeout time.Duration) func(next HandlerC) HandlerC {
 	return func(next HandlerC) HandlerC {
 		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
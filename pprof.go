@@ -0,0 +1,76 @@
+package xhandler
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+
+	"context"
+)
+
+// PprofOptions configures PprofLabels. Empty label values are not set.
+type PprofOptions struct {
+	// Route returns the value of the route label. Keep it low cardinality
+	// (route patterns, not raw paths).
+	Route func(ctx context.Context, r *http.Request) string
+	// Tenant returns the value of the tenant label.
+	Tenant func(ctx context.Context, r *http.Request) string
+	// ContextKeys maps label names to context keys. The value stored under
+	// each key, if any, is formatted with fmt.Sprint.
+	ContextKeys map[string]interface{}
+}
+
+// PprofLabels returns a handler applying runtime/pprof labels (method,
+// route, tenant and custom context values) to the goroutine serving the
+// request for its whole duration, so CPU and goroutine profiles can be
+// filtered per endpoint (go tool pprof -tagfocus route=...).
+//
+// Goroutines started by the handler inherit its labels. Use GoWithLabels to
+// run work with the request labels on goroutines started elsewhere, like in
+// a worker pool.
+func PprofLabels(o PprofOptions) func(next HandlerC) HandlerC {
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			labels := []string{"method", r.Method}
+			if o.Route != nil {
+				labels = appendLabel(labels, "route", o.Route(ctx, r))
+			}
+			if o.Tenant != nil {
+				labels = appendLabel(labels, "tenant", o.Tenant(ctx, r))
+			}
+			for name, key := range o.ContextKeys {
+				if v := ctx.Value(key); v != nil {
+					labels = appendLabel(labels, name, fmt.Sprint(v))
+				}
+			}
+			pprof.Do(ctx, pprof.Labels(labels...), func(ctx context.Context) {
+				next.ServeHTTPC(ctx, w, r)
+			})
+		})
+	}
+}
+
+func appendLabel(labels []string, name, value string) []string {
+	if value == "" {
+		return labels
+	}
+	return append(labels, name, value)
+}
+
+// AddPprofLabels adds label key/value pairs to the labels of ctx and applies
+// them to the current goroutine. It is useful when a label is only known
+// late, like the route after a router matched it. The labels stay on the
+// goroutine until the PprofLabels handler returns.
+func AddPprofLabels(ctx context.Context, kv ...string) context.Context {
+	ctx = pprof.WithLabels(ctx, pprof.Labels(kv...))
+	pprof.SetGoroutineLabels(ctx)
+	return ctx
+}
+
+// GoWithLabels runs f in a new goroutine carrying the pprof labels of ctx.
+func GoWithLabels(ctx context.Context, f func(ctx context.Context)) {
+	go func() {
+		pprof.SetGoroutineLabels(ctx)
+		f(ctx)
+	}()
+}
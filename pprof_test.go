@@ -0,0 +1,41 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprofLabels(t *testing.T) {
+	h := PprofLabels(PprofOptions{
+		Route: func(ctx context.Context, r *http.Request) string {
+			return "/users/:id"
+		},
+		Tenant: func(ctx context.Context, r *http.Request) string {
+			return ""
+		},
+		ContextKeys: map[string]interface{}{"test": contextKey},
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		labels := map[string]string{}
+		pprof.ForLabels(ctx, func(k, v string) bool {
+			labels[k] = v
+			return true
+		})
+		assert.Equal(t, map[string]string{"method": "GET", "route": "/users/:id", "test": "value"}, labels)
+
+		ctx = AddPprofLabels(ctx, "user", "42")
+		done := make(chan string)
+		GoWithLabels(ctx, func(ctx context.Context) {
+			v, _ := pprof.Label(ctx, "user")
+			done <- v
+		})
+		assert.Equal(t, "42", <-done)
+	}))
+	ctx := context.WithValue(context.Background(), contextKey, "value")
+	h.ServeHTTPC(ctx, httptest.NewRecorder(), testRequest)
+}
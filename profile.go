@@ -0,0 +1,192 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// StageTiming is the time spent in a chain stage during a request. Total
+// includes the time spent in the following stages while Self excludes it.
+type StageTiming struct {
+	Stage Stage
+	Self  time.Duration
+	Total time.Duration
+}
+
+// Profiler measures the self and total time of each entry of a chain and
+// aggregates them in per-stage histograms. Its Hook method is a StageHook
+// to pass to Chain.Instrument:
+//
+//  p := xhandler.NewProfiler(nil, nil)
+//  mux.Handle("/", c.Instrument(p.Hook).Handler(h))
+//  mux.Handle("/debug/chain", xhandler.New(ctx, p))
+type Profiler struct {
+	// OnRequest is called, if set, at the end of each request with the
+	// timing of the stages that ran, in chain order.
+	OnRequest func(ctx context.Context, r *http.Request, timings []StageTiming)
+
+	self  *HistogramVec
+	total *HistogramVec
+
+	mu     sync.RWMutex
+	stages map[string]Stage
+}
+
+// NewProfiler creates a profiler recording stage timings in histograms with
+// the given buckets (DefBuckets if nil) registered in reg as
+// chain_stage_self_seconds and chain_stage_total_seconds. If reg is nil, a
+// private registry is used.
+func NewProfiler(reg *Registry, buckets []float64) *Profiler {
+	if reg == nil {
+		reg = NewRegistry()
+	}
+	return &Profiler{
+		self: reg.Histogram("chain_stage_self_seconds",
+			"Time spent in a chain stage excluding the following stages.", buckets, "stage"),
+		total: reg.Histogram("chain_stage_total_seconds",
+			"Time spent in a chain stage including the following stages.", buckets, "stage"),
+		stages: map[string]Stage{},
+	}
+}
+
+type profileCtxKey struct{}
+
+// profileRun holds the stage timings of a single request.
+type profileRun struct {
+	stages []Stage
+	totals []time.Duration
+	ran    []bool
+}
+
+func (run *profileRun) add(s Stage, d time.Duration) {
+	for len(run.stages) <= s.Index {
+		run.stages = append(run.stages, Stage{})
+		run.totals = append(run.totals, 0)
+		run.ran = append(run.ran, false)
+	}
+	run.stages[s.Index] = s
+	run.totals[s.Index] += d
+	run.ran[s.Index] = true
+}
+
+// Hook implements StageHook.
+func (p *Profiler) Hook(s Stage, h HandlerC) HandlerC {
+	p.mu.Lock()
+	p.stages[s.String()] = s
+	p.mu.Unlock()
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		run, _ := ctx.Value(profileCtxKey{}).(*profileRun)
+		if s.Index == 0 || run == nil {
+			run = &profileRun{}
+			ctx = context.WithValue(ctx, profileCtxKey{}, run)
+			defer p.record(ctx, r, run)
+		}
+		start := time.Now()
+		defer func() {
+			run.add(s, time.Since(start))
+		}()
+		h.ServeHTTPC(ctx, w, r)
+	})
+}
+
+func (p *Profiler) record(ctx context.Context, r *http.Request, run *profileRun) {
+	timings := make([]StageTiming, 0, len(run.stages))
+	for i, s := range run.stages {
+		if !run.ran[i] {
+			continue
+		}
+		t := StageTiming{Stage: s, Self: run.totals[i], Total: run.totals[i]}
+		if i+1 < len(run.stages) && run.ran[i+1] {
+			t.Self -= run.totals[i+1]
+		}
+		label := s.String()
+		p.self.With(label).Observe(t.Self.Seconds())
+		p.total.With(label).Observe(t.Total.Seconds())
+		timings = append(timings, t)
+	}
+	if p.OnRequest != nil {
+		p.OnRequest(ctx, r, timings)
+	}
+}
+
+// StageStats are the aggregated timings of a chain stage. Durations are in
+// seconds.
+type StageStats struct {
+	Index int            `json:"index"`
+	Name  string         `json:"name"`
+	Count uint64         `json:"count"`
+	Self  DurationsStats `json:"self"`
+	Total DurationsStats `json:"total"`
+}
+
+// DurationsStats summarizes a duration histogram, in seconds.
+type DurationsStats struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+}
+
+func durationsStats(h Histogram) DurationsStats {
+	ds := DurationsStats{}
+	n := h.Count()
+	if n == 0 {
+		return ds
+	}
+	// NaN (no buckets) can't be encoded in JSON
+	quantile := func(q float64) float64 {
+		if v := h.Quantile(q); !math.IsNaN(v) {
+			return v
+		}
+		return 0
+	}
+	ds.Mean = h.Sum() / float64(n)
+	ds.P50 = quantile(.5)
+	ds.P90 = quantile(.9)
+	ds.P99 = quantile(.99)
+	return ds
+}
+
+// Stats returns the aggregated timings of all the stages seen so far, in
+// chain order. Quantiles are estimated from the histogram buckets.
+func (p *Profiler) Stats() []StageStats {
+	p.mu.RLock()
+	stages := make([]Stage, 0, len(p.stages))
+	for _, s := range p.stages {
+		stages = append(stages, s)
+	}
+	p.mu.RUnlock()
+	sort.Slice(stages, func(i, j int) bool {
+		if stages[i].Index != stages[j].Index {
+			return stages[i].Index < stages[j].Index
+		}
+		return stages[i].Name < stages[j].Name
+	})
+	stats := make([]StageStats, 0, len(stages))
+	for _, s := range stages {
+		self, total := p.self.With(s.String()), p.total.With(s.String())
+		stats = append(stats, StageStats{
+			Index: s.Index,
+			Name:  s.Name,
+			Count: total.Count(),
+			Self:  durationsStats(self),
+			Total: durationsStats(total),
+		})
+	}
+	return stats
+}
+
+// ServeHTTPC implements HandlerC, serving the stage stats as JSON.
+func (p *Profiler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	stats := p.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
@@ -0,0 +1,81 @@
+package xhandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sleepHandler(d time.Duration) func(next HandlerC) HandlerC {
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			next.ServeHTTPC(ctx, w, r)
+		})
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	p := NewProfiler(nil, nil)
+	var timings []StageTiming
+	p.OnRequest = func(ctx context.Context, r *http.Request, t []StageTiming) {
+		timings = t
+	}
+	c := Chain{}
+	c.UseC(sleepHandler(20 * time.Millisecond))
+	c.UseC(CloseHandler)
+	h := c.Instrument(p.Hook).HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+
+	if assert.Len(t, timings, 3) {
+		assert.Equal(t, 0, timings[0].Stage.Index)
+		assert.Equal(t, "xhandler.CloseHandler", timings[1].Stage.Name)
+		assert.True(t, timings[2].Stage.Final)
+		assert.True(t, timings[0].Self >= 20*time.Millisecond)
+		assert.True(t, timings[0].Self < timings[0].Total)
+		assert.True(t, timings[1].Self < 10*time.Millisecond)
+		assert.True(t, timings[2].Self >= 10*time.Millisecond)
+		assert.Equal(t, timings[2].Self, timings[2].Total)
+		assert.True(t, timings[1].Total >= timings[2].Total)
+	}
+
+	stats := p.Stats()
+	if assert.Len(t, stats, 3) {
+		assert.Equal(t, uint64(1), stats[0].Count)
+		assert.True(t, stats[0].Total.Mean >= 0.03)
+		assert.Equal(t, "xhandler.CloseHandler", stats[1].Name)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTPC(context.Background(), w, testRequest)
+	var out []StageStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	assert.Len(t, out, 3)
+}
+
+func TestProfilerShortCircuit(t *testing.T) {
+	p := NewProfiler(nil, nil)
+	var timings []StageTiming
+	p.OnRequest = func(ctx context.Context, r *http.Request, t []StageTiming) {
+		timings = t
+	}
+	c := Chain{}
+	c.UseC(func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+	})
+	h := c.Instrument(p.Hook).HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {})
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	if assert.Len(t, timings, 1) {
+		assert.Equal(t, timings[0].Self, timings[0].Total)
+	}
+}
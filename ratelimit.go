@@ -0,0 +1,244 @@
+package xhandler
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// TokenBucket describes a token bucket: it holds up to Burst tokens and is
+// refilled at Rate tokens per second. Each request takes a token.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+}
+
+// Every returns the rate of one token every d.
+func Every(d time.Duration) float64 {
+	if d <= 0 {
+		return math.Inf(1)
+	}
+	return float64(time.Second) / float64(d)
+}
+
+// TakeResult is the outcome of RateLimitStore.Take.
+type TakeResult struct {
+	// Allowed tells if a token was taken.
+	Allowed bool
+	// Remaining is the number of tokens left in the bucket.
+	Remaining int
+	// RetryAfter is the time until a token is available, if not allowed. It
+	// is negative if the bucket never refills.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+// RateLimitStore stores token buckets by key. Take must atomically refill
+// the bucket of key for the time elapsed since its last use, then take a
+// token if one is available. A missing bucket is full. Implementations
+// backed by a shared store let several instances enforce a common limit;
+// the ratelimittest package provides a test suite checking this contract.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, b TokenBucket, now time.Time) (TakeResult, error)
+}
+
+// MemoryStore is an in-memory RateLimitStore. Buckets are spread over
+// shards with their own lock to limit contention, and full buckets are
+// evicted as they are equivalent to missing ones.
+type MemoryStore struct {
+	shards []memoryShard
+}
+
+type memoryShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // zero if the bucket never refills
+}
+
+// sweepInterval is the minimum time between two evictions of full buckets
+// in a MemoryStore shard.
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates an in-memory store with the given number of
+// shards. It defaults to 32 if shards is not positive.
+func NewMemoryStore(shards int) *MemoryStore {
+	if shards <= 0 {
+		shards = 32
+	}
+	s := &MemoryStore{shards: make([]memoryShard, shards)}
+	for i := range s.shards {
+		s.shards[i].buckets = map[string]*memoryBucket{}
+	}
+	return s
+}
+
+// Len returns the number of buckets held in memory.
+func (s *MemoryStore) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += len(sh.buckets)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryStore) Take(ctx context.Context, key string, b TokenBucket, now time.Time) (TakeResult, error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	sh := &s.shards[h.Sum32()%uint32(len(s.shards))]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if now.Sub(sh.lastSweep) >= sweepInterval {
+		for k, bk := range sh.buckets {
+			if !bk.full.IsZero() && !now.Before(bk.full) {
+				delete(sh.buckets, k)
+			}
+		}
+		sh.lastSweep = now
+	}
+	bk, found := sh.buckets[key]
+	if !found {
+		bk = &memoryBucket{tokens: float64(b.Burst), last: now}
+		sh.buckets[key] = bk
+	}
+	return takeToken(bk, b, now), nil
+}
+
+// takeToken refills bk at now and takes a token if available.
+func takeToken(bk *memoryBucket, b TokenBucket, now time.Time) TakeResult {
+	burst := float64(b.Burst)
+	if elapsed := now.Sub(bk.last); elapsed > 0 {
+		bk.tokens = math.Min(burst, bk.tokens+elapsed.Seconds()*b.Rate)
+		bk.last = now
+	}
+	var res TakeResult
+	if bk.tokens >= 1 {
+		bk.tokens--
+		res.Allowed = true
+	} else if b.Rate > 0 && b.Burst > 0 {
+		res.RetryAfter = rateDuration(1-bk.tokens, b.Rate)
+	} else {
+		// The bucket never refills
+		res.RetryAfter = -1
+	}
+	res.Remaining = int(bk.tokens)
+	if b.Rate > 0 {
+		res.Reset = rateDuration(burst-bk.tokens, b.Rate)
+		bk.full = now.Add(res.Reset)
+	} else {
+		bk.full = time.Time{}
+	}
+	return res
+}
+
+// rateDuration returns the time needed to get tokens at rate, rounded up.
+func rateDuration(tokens, rate float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / rate * float64(time.Second)))
+}
+
+// RateLimitOptions configures RateLimitHandler.
+type RateLimitOptions struct {
+	// Name identifies the limiter in metrics.
+	Name string
+	// Bucket is the token bucket applied to each key.
+	Bucket TokenBucket
+	// Key returns the key requests are limited by (see KeyByIP,
+	// KeyByHeader and KeyByContext). Requests with an empty key are not
+	// limited. If nil, all requests share the same bucket.
+	Key func(ctx context.Context, r *http.Request) string
+	// Store holds the buckets. Defaults to a MemoryStore.
+	Store RateLimitStore
+	// FailClosed makes requests be rejected with a 503 when the store
+	// returns an error. By default, they are served.
+	FailClosed bool
+	// Registry, if set, receives a rate_limited_requests_total counter
+	// labelled by limiter.
+	Registry *Registry
+}
+
+// RateLimitHandler returns a handler limiting the request rate per key with
+// a token bucket. Requests over the limit get a 429 Too Many Requests
+// response with a Retry-After header.
+func RateLimitHandler(o RateLimitOptions) func(next HandlerC) HandlerC {
+	if o.Store == nil {
+		o.Store = NewMemoryStore(0)
+	}
+	var limited *CounterVec
+	if o.Registry != nil {
+		limited = o.Registry.Counter("rate_limited_requests_total",
+			"Number of requests rejected by the rate limiter.", "limiter")
+	}
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			key := ""
+			if o.Key != nil {
+				if key = o.Key(ctx, r); key == "" {
+					next.ServeHTTPC(ctx, w, r)
+					return
+				}
+			}
+			res, err := o.Store.Take(ctx, key, o.Bucket, time.Now())
+			if err != nil {
+				if o.FailClosed {
+					http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+					return
+				}
+				next.ServeHTTPC(ctx, w, r)
+				return
+			}
+			if !res.Allowed {
+				if limited != nil {
+					limited.With(o.Name).Inc()
+				}
+				if res.RetryAfter > 0 {
+					w.Header().Set("Retry-After", retryAfter(res.RetryAfter))
+				}
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTPC(ctx, w, r)
+		})
+	}
+}
+
+// KeyByIP keys requests by client IP address, taken from the connection. Use
+// a middleware rewriting RemoteAddr if the service is behind a trusted proxy.
+func KeyByIP(ctx context.Context, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader returns a key function using the value of the header name,
+// like an API key.
+func KeyByHeader(name string) func(ctx context.Context, r *http.Request) string {
+	return func(ctx context.Context, r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// KeyByContext returns a key function using the string value stored in the
+// context under k, like an authenticated user ID.
+func KeyByContext(k interface{}) func(ctx context.Context, r *http.Request) string {
+	return func(ctx context.Context, r *http.Request) string {
+		v, _ := ctx.Value(k).(string)
+		return v
+	}
+}
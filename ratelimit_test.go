@@ -0,0 +1,91 @@
+package xhandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, b TokenBucket, now time.Time) (TakeResult, error) {
+	return TakeResult{}, errors.New("store down")
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	reg := NewRegistry()
+	h := RateLimitHandler(RateLimitOptions{
+		Name:     "api",
+		Bucket:   TokenBucket{Rate: Every(2 * time.Second), Burst: 2},
+		Key:      KeyByHeader("X-Api-Key"),
+		Registry: reg,
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {}))
+	serve := func(apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		h.ServeHTTPC(context.Background(), w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, serve("a").Code)
+	assert.Equal(t, http.StatusOK, serve("a").Code)
+	w := serve("a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve("b").Code)
+	for i := 0; i < 5; i++ {
+		// Requests without a key are not limited
+		assert.Equal(t, http.StatusOK, serve("").Code)
+	}
+	assert.Equal(t, 1.0, reg.Counter("rate_limited_requests_total", "", "limiter").With("api").Value())
+}
+
+func TestRateLimitHandlerStoreError(t *testing.T) {
+	next := HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {})
+	for failClosed, want := range map[bool]int{false: http.StatusOK, true: http.StatusServiceUnavailable} {
+		h := RateLimitHandler(RateLimitOptions{Store: failingStore{}, FailClosed: failClosed})(next)
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		h.ServeHTTPC(context.Background(), w, r)
+		assert.Equal(t, want, w.Code, "fail closed %v", failClosed)
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	s := NewMemoryStore(1)
+	b := TokenBucket{Rate: 1, Burst: 5}
+	now := time.Now()
+	ctx := context.Background()
+	s.Take(ctx, "a", b, now)
+	s.Take(ctx, "b", b, now)
+	s.Take(ctx, "never", TokenBucket{Rate: 0, Burst: 1}, now)
+	assert.Equal(t, 3, s.Len())
+	// a is full again after 1s but the next sweep is due in a minute
+	s.Take(ctx, "c", b, now.Add(2*time.Second))
+	assert.Equal(t, 4, s.Len())
+	s.Take(ctx, "c", b, now.Add(sweepInterval+time.Second))
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Api-Key", "secret")
+	ctx := context.WithValue(context.Background(), contextKey, "john")
+	assert.Equal(t, "10.0.0.1", KeyByIP(ctx, r))
+	r.RemoteAddr = "[::1]:80"
+	assert.Equal(t, "::1", KeyByIP(ctx, r))
+	r.RemoteAddr = "pipe"
+	assert.Equal(t, "pipe", KeyByIP(ctx, r))
+	assert.Equal(t, "secret", KeyByHeader("X-Api-Key")(ctx, r))
+	assert.Equal(t, "john", KeyByContext(contextKey)(ctx, r))
+	assert.Equal(t, "", KeyByContext(key(42))(ctx, r))
+}
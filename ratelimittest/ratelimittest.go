@@ -0,0 +1,147 @@
+// Package ratelimittest provides a test suite checking xhandler.RateLimitStore
+// implementations honor the store contract.
+//
+//  func TestRedisStore(t *testing.T) {
+//      ratelimittest.TestStore(t, func() xhandler.RateLimitStore {
+//          return NewRedisStore(flushedTestClient(t))
+//      })
+//  }
+package ratelimittest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/rs/xhandler"
+	"github.com/stretchr/testify/assert"
+)
+
+// Precision is the tolerance allowed on the durations returned by stores.
+const Precision = time.Millisecond
+
+// TestStore runs the contract test suite against stores created by newStore.
+// Each sub test gets a new, empty store.
+func TestStore(t *testing.T, newStore func() xhandler.RateLimitStore) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s xhandler.RateLimitStore)
+	}{
+		{"Burst", testBurst},
+		{"Refill", testRefill},
+		{"RefillCapped", testRefillCapped},
+		{"Keys", testKeys},
+		{"NoRefill", testNoRefill},
+		{"Concurrent", testConcurrent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newStore())
+		})
+	}
+}
+
+var (
+	// epoch is a fixed point in time so results don't depend on the clock.
+	epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// tenPerSec refills a token every 100ms.
+	tenPerSec = xhandler.TokenBucket{Rate: 10, Burst: 3}
+)
+
+func take(t *testing.T, s xhandler.RateLimitStore, key string, b xhandler.TokenBucket, now time.Time) xhandler.TakeResult {
+	t.Helper()
+	res, err := s.Take(context.Background(), key, b, now)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return res
+}
+
+func assertDuration(t *testing.T, want, got time.Duration, msg string) {
+	t.Helper()
+	assert.InDelta(t, float64(want), float64(got), float64(Precision), "%s: want %s, got %s", msg, want, got)
+}
+
+func testBurst(t *testing.T, s xhandler.RateLimitStore) {
+	for i := 0; i < tenPerSec.Burst; i++ {
+		res := take(t, s, "k", tenPerSec, epoch)
+		assert.True(t, res.Allowed, "take %d", i)
+		assert.Equal(t, tenPerSec.Burst-i-1, res.Remaining, "take %d", i)
+		assertDuration(t, time.Duration(i+1)*100*time.Millisecond, res.Reset, fmt.Sprintf("take %d reset", i))
+	}
+	res := take(t, s, "k", tenPerSec, epoch)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assertDuration(t, 100*time.Millisecond, res.RetryAfter, "retry after")
+	assertDuration(t, 300*time.Millisecond, res.Reset, "reset")
+}
+
+func testRefill(t *testing.T, s xhandler.RateLimitStore) {
+	for i := 0; i < tenPerSec.Burst; i++ {
+		take(t, s, "k", tenPerSec, epoch)
+	}
+	res := take(t, s, "k", tenPerSec, epoch.Add(40*time.Millisecond))
+	assert.False(t, res.Allowed)
+	assertDuration(t, 60*time.Millisecond, res.RetryAfter, "retry after")
+
+	res = take(t, s, "k", tenPerSec, epoch.Add(100*time.Millisecond))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	res = take(t, s, "k", tenPerSec, epoch.Add(100*time.Millisecond))
+	assert.False(t, res.Allowed)
+
+	res = take(t, s, "k", tenPerSec, epoch.Add(350*time.Millisecond))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+}
+
+func testRefillCapped(t *testing.T, s xhandler.RateLimitStore) {
+	take(t, s, "k", tenPerSec, epoch)
+	// Idle long enough to refill way more than the burst
+	later := epoch.Add(time.Hour)
+	for i := 0; i < tenPerSec.Burst; i++ {
+		assert.True(t, take(t, s, "k", tenPerSec, later).Allowed, "take %d", i)
+	}
+	assert.False(t, take(t, s, "k", tenPerSec, later).Allowed)
+}
+
+func testKeys(t *testing.T, s xhandler.RateLimitStore) {
+	b := xhandler.TokenBucket{Rate: 1, Burst: 1}
+	assert.True(t, take(t, s, "a", b, epoch).Allowed)
+	assert.False(t, take(t, s, "a", b, epoch).Allowed)
+	assert.True(t, take(t, s, "b", b, epoch).Allowed)
+	assert.True(t, take(t, s, "", b, epoch).Allowed)
+}
+
+func testNoRefill(t *testing.T, s xhandler.RateLimitStore) {
+	b := xhandler.TokenBucket{Rate: 0, Burst: 1}
+	assert.True(t, take(t, s, "k", b, epoch).Allowed)
+	res := take(t, s, "k", b, epoch.Add(time.Hour))
+	assert.False(t, res.Allowed)
+	assert.True(t, res.RetryAfter < 0, "retry after %s", res.RetryAfter)
+}
+
+func testConcurrent(t *testing.T, s xhandler.RateLimitStore) {
+	b := xhandler.TokenBucket{Rate: 1, Burst: 20}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.Take(context.Background(), "k", b, epoch)
+			assert.NoError(t, err)
+			if res.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, b.Burst, allowed)
+}
@@ -0,0 +1,13 @@
+package ratelimittest
+
+import (
+	"testing"
+
+	"github.com/rs/xhandler"
+)
+
+func TestMemoryStore(t *testing.T) {
+	TestStore(t, func() xhandler.RateLimitStore {
+		return xhandler.NewMemoryStore(4)
+	})
+}
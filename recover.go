@@ -0,0 +1,132 @@
+package xhandler
+
+import (
+	"fmt"
+	"net/http"
+
+	"context"
+)
+
+// Panic describes a panic recovered by RecoverHandler.
+type Panic struct {
+	// Value is the value passed to panic.
+	Value      interface{}
+	Stack      []byte
+	Method     string
+	URL        string
+	RemoteAddr string
+	// Header is a copy of the request headers with the values of the
+	// credential headers, like Authorization or Cookie, redacted.
+	Header http.Header
+	// Values holds the context values listed in RecoverOptions.ContextKeys.
+	Values map[string]interface{}
+	// HeadersSent is true if the response had already started, in which case
+	// no error response could be sent and the connection is aborted.
+	HeadersSent bool
+}
+
+func (p Panic) Error() string {
+	return fmt.Sprintf("panic serving %s %s: %v", p.Method, p.URL, p.Value)
+}
+
+// credentialHeaders lists the request headers redacted from panic reports.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactHeader returns a copy of h with the credentials redacted.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range credentialHeaders {
+		if _, ok := h[name]; ok {
+			h[name] = []string{"REDACTED"}
+		}
+	}
+	return h
+}
+
+// PanicReporter receives the panics recovered by RecoverHandler.
+type PanicReporter interface {
+	ReportPanic(ctx context.Context, p Panic)
+}
+
+// PanicReporterFunc is an adapter to allow the use of ordinary functions as
+// PanicReporter.
+type PanicReporterFunc func(ctx context.Context, p Panic)
+
+// ReportPanic calls f(ctx, p).
+func (f PanicReporterFunc) ReportPanic(ctx context.Context, p Panic) {
+	f(ctx, p)
+}
+
+// RecoverOptions configures RecoverHandler.
+type RecoverOptions struct {
+	// Reporter receives the recovered panics. If nil, panics are not
+	// reported.
+	Reporter PanicReporter
+	// ContextKeys maps names to context keys whose values are added to the
+	// report.
+	ContextKeys map[string]interface{}
+	// Handler writes the error response. Defaults to a plain 500 Internal
+	// Server Error.
+	Handler HandlerC
+}
+
+// RecoverHandler returns a handler recovering from panics in sub handlers.
+// The panic is reported with its stack and request details and, if the
+// response headers were not sent yet, an error response is written.
+// Otherwise the connection is aborted so the client can't mistake the
+// truncated response for a complete one.
+//
+// Panics with http.ErrAbortHandler are left to net/http untouched.
+func RecoverHandler(o RecoverOptions) func(next HandlerC) HandlerC {
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			rw := wrapWriter(w)
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				// Middleware down the chain may have recorded the stack
+				// already, the panic stops here.
+				hp := rw.recordPanic(v)
+				rw.panic = nil
+				p := Panic{
+					Value:       v,
+					Stack:       hp.stack,
+					Method:      r.Method,
+					URL:         r.URL.String(),
+					RemoteAddr:  r.RemoteAddr,
+					Header:      redactHeader(r.Header),
+					HeadersSent: rw.Written(),
+				}
+				if len(o.ContextKeys) > 0 {
+					p.Values = map[string]interface{}{}
+					for name, key := range o.ContextKeys {
+						p.Values[name] = ctx.Value(key)
+					}
+				}
+				SpanFromContext(ctx).RecordError(p)
+				if o.Reporter != nil {
+					o.Reporter.ReportPanic(ctx, p)
+				}
+				if p.HeadersSent {
+					panic(http.ErrAbortHandler)
+				}
+				// Drop the headers set by the handler for its own response
+				h := rw.Header()
+				for k := range h {
+					delete(h, k)
+				}
+				if o.Handler != nil {
+					o.Handler.ServeHTTPC(ctx, rw, r)
+					return
+				}
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}()
+			next.ServeHTTPC(ctx, rw, r)
+		})
+	}
+}
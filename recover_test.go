@@ -0,0 +1,102 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverHandler(t *testing.T) {
+	var reported []Panic
+	h := RecoverHandler(RecoverOptions{
+		Reporter: PanicReporterFunc(func(ctx context.Context, p Panic) {
+			reported = append(reported, p)
+		}),
+		ContextKeys: map[string]interface{}{"test": contextKey},
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Partial", "1")
+		panic("boom")
+	}))
+	ctx := context.WithValue(context.Background(), contextKey, "value")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("Accept", "text/plain")
+	assert.NotPanics(t, func() {
+		h.ServeHTTPC(ctx, w, r)
+	})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Internal Server Error\n", w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Partial"))
+	assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"), "request left untouched")
+	if assert.Len(t, reported, 1) {
+		p := reported[0]
+		assert.Equal(t, "boom", p.Value)
+		assert.Equal(t, "value", p.Values["test"])
+		assert.False(t, p.HeadersSent)
+		assert.Equal(t, "REDACTED", p.Header.Get("Authorization"))
+		assert.Equal(t, "REDACTED", p.Header.Get("Cookie"))
+		assert.Equal(t, "text/plain", p.Header.Get("Accept"))
+		assert.Contains(t, string(p.Stack), "TestRecoverHandler")
+		assert.Equal(t, "panic serving GET /: boom", p.Error())
+	}
+}
+
+func TestRecoverHandlerCustomResponse(t *testing.T) {
+	exp := &InMemoryExporter{}
+	c := Chain{}
+	c.UseC(TraceHandler(TraceOptions{Exporter: exp}))
+	c.UseC(RecoverHandler(RecoverOptions{
+		Handler: HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "sorry", http.StatusServiceUnavailable)
+		}),
+	}))
+	h := c.HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	if spans := exp.Spans(); assert.Len(t, spans, 1) {
+		assert.Equal(t, StatusError, spans[0].Status)
+		assert.Equal(t, []string{"panic serving GET /: boom"}, spans[0].Errors)
+	}
+}
+
+func TestRecoverHandlerHeadersSent(t *testing.T) {
+	reported := false
+	h := RecoverHandler(RecoverOptions{
+		Reporter: PanicReporterFunc(func(ctx context.Context, p Panic) {
+			reported = p.HeadersSent
+		}),
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTPC(context.Background(), w, testRequest)
+	})
+	assert.True(t, reported)
+	assert.Equal(t, "partial", w.Body.String())
+}
+
+func TestRecoverHandlerAbort(t *testing.T) {
+	reported := false
+	h := RecoverHandler(RecoverOptions{
+		Reporter: PanicReporterFunc(func(ctx context.Context, p Panic) {
+			reported = true
+		}),
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	})
+	assert.False(t, reported)
+}
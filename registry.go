@@ -0,0 +1,433 @@
+package xhandler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"context"
+)
+
+// DefBuckets are the default latency histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefSizeBuckets are the default response size histogram buckets, in bytes.
+var DefSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// OverflowLabel is the label value used for all labels of the series
+// collecting samples once a metric family reached its series limit.
+const OverflowLabel = "__overflow__"
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Registry holds metric families and renders them using the Prometheus text
+// exposition format (or OpenMetrics if the client asks for it). It
+// implements HandlerC so it can be mounted directly as the metrics endpoint.
+type Registry struct {
+	// MaxSeries is the maximum number of label combinations a family
+	// created after it is set may hold. Once reached, new combinations are
+	// aggregated into a single series labelled with OverflowLabel. Zero
+	// means no limit.
+	MaxSeries int
+
+	mu       sync.RWMutex
+	families map[string]*metricFamily
+}
+
+// NewRegistry creates an empty metrics registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*metricFamily{}}
+}
+
+type metricFamily struct {
+	name      string
+	help      string
+	typ       string
+	labels    []string
+	buckets   []float64
+	maxSeries int
+
+	mu     sync.RWMutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	// Atomically accessed fields first for 64-bit alignment
+	value  uint64 // float64 bits for counters and gauges, sum for histograms
+	count  uint64
+	counts []uint64
+	values []string
+}
+
+func addFloat(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(addr, old, n) {
+			return
+		}
+	}
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.families == nil {
+		r.families = map[string]*metricFamily{}
+	}
+	if f, found := r.families[name]; found {
+		if f.typ != typ || len(f.labels) != len(labels) {
+			panic(fmt.Sprintf("xhandler: metric %s registered twice with different definitions", name))
+		}
+		return f
+	}
+	f := &metricFamily{
+		name:      name,
+		help:      help,
+		typ:       typ,
+		labels:    labels,
+		buckets:   buckets,
+		maxSeries: r.MaxSeries,
+		series:    map[string]*metricSeries{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// get returns the series for the given label values, creating it if needed.
+func (f *metricFamily) get(values []string) *metricSeries {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("xhandler: metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	f.mu.RLock()
+	s, found := f.series[k]
+	f.mu.RUnlock()
+	if found {
+		return s
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, found = f.series[k]; found {
+		return s
+	}
+	if f.maxSeries > 0 && len(f.series) >= f.maxSeries {
+		values = make([]string, len(f.labels))
+		for i := range values {
+			values[i] = OverflowLabel
+		}
+		k = strings.Join(values, "\xff")
+		if s, found = f.series[k]; found {
+			return s
+		}
+	}
+	s = &metricSeries{values: append([]string(nil), values...)}
+	if f.typ == "histogram" {
+		s.counts = make([]uint64, len(f.buckets))
+	}
+	f.series[k] = s
+	return s
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	f *metricFamily
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	s *metricSeries
+}
+
+// Counter registers (or returns the existing) counter family with the given
+// name, help text and label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, "counter", nil, labels)}
+}
+
+// With returns the counter for the given label values.
+func (v *CounterVec) With(values ...string) Counter {
+	return Counter{v.f.get(values)}
+}
+
+// Inc increments the counter by one.
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v to the counter. Negative values are ignored.
+func (c Counter) Add(v float64) {
+	if v > 0 {
+		addFloat(&c.s.value, v)
+	}
+}
+
+// Value returns the current value of the counter.
+func (c Counter) Value() float64 {
+	return loadFloat(&c.s.value)
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	f *metricFamily
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	s *metricSeries
+}
+
+// Gauge registers (or returns the existing) gauge family with the given
+// name, help text and label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, "gauge", nil, labels)}
+}
+
+// With returns the gauge for the given label values.
+func (v *GaugeVec) With(values ...string) Gauge {
+	return Gauge{v.f.get(values)}
+}
+
+// Set sets the gauge to v.
+func (g Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.s.value, math.Float64bits(v))
+}
+
+// Add adds v (which may be negative) to the gauge.
+func (g Gauge) Add(v float64) {
+	addFloat(&g.s.value, v)
+}
+
+// Inc increments the gauge by one.
+func (g Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by one.
+func (g Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the current value of the gauge.
+func (g Gauge) Value() float64 {
+	return loadFloat(&g.s.value)
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	f *metricFamily
+}
+
+// Histogram counts observations into configurable buckets.
+type Histogram struct {
+	f *metricFamily
+	s *metricSeries
+}
+
+// Histogram registers (or returns the existing) histogram family with the
+// given name, help text, upper bucket bounds and label names. If buckets is
+// nil, DefBuckets is used.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{r.register(name, help, "histogram", b, labels)}
+}
+
+// With returns the histogram for the given label values.
+func (v *HistogramVec) With(values ...string) Histogram {
+	return Histogram{v.f, v.f.get(values)}
+}
+
+// Observe adds a single observation to the histogram.
+func (h Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(h.s.counts) {
+		atomic.AddUint64(&h.s.counts[i], 1)
+	}
+	addFloat(&h.s.value, v)
+	atomic.AddUint64(&h.s.count, 1)
+}
+
+// Count returns the number of observations.
+func (h Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.s.count)
+}
+
+// Sum returns the sum of all observations.
+func (h Histogram) Sum() float64 {
+	return loadFloat(&h.s.value)
+}
+
+// Quantile estimates the q-quantile (0 <= q <= 1) of the observations by
+// linear interpolation within the bucket holding it, like Prometheus'
+// histogram_quantile does. It returns NaN if there is no observation and
+// the highest bucket bound if the quantile falls in the +Inf bucket.
+func (h Histogram) Quantile(q float64) float64 {
+	count := atomic.LoadUint64(&h.s.count)
+	if count == 0 || len(h.f.buckets) == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(count)
+	var cum uint64
+	for i, b := range h.f.buckets {
+		c := atomic.LoadUint64(&h.s.counts[i])
+		if float64(cum+c) >= rank && c > 0 {
+			lower := 0.0
+			if i > 0 {
+				lower = h.f.buckets[i-1]
+			}
+			return lower + (b-lower)*(rank-float64(cum))/float64(c)
+		}
+		cum += c
+	}
+	return h.f.buckets[len(h.f.buckets)-1]
+}
+
+// ServeHTTPC implements HandlerC, rendering all registered metrics.
+func (r *Registry) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	om := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+	if om {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypeText)
+	}
+	r.Write(w, om)
+}
+
+// Write renders all registered metrics to out using the Prometheus text
+// format, or the OpenMetrics text format if openMetrics is true.
+func (r *Registry) Write(out io.Writer, openMetrics bool) error {
+	r.mu.RLock()
+	fams := make([]*metricFamily, 0, len(r.families))
+	for _, f := range r.families {
+		fams = append(fams, f)
+	}
+	r.mu.RUnlock()
+	sort.Slice(fams, func(i, j int) bool { return fams[i].name < fams[j].name })
+
+	bw := bufio.NewWriter(out)
+	for _, f := range fams {
+		f.write(bw, openMetrics)
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func (f *metricFamily) write(w *bufio.Writer, openMetrics bool) {
+	f.mu.RLock()
+	series := make([]*metricSeries, 0, len(f.series))
+	for _, s := range f.series {
+		series = append(series, s)
+	}
+	f.mu.RUnlock()
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i].values, series[j].values
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	// OpenMetrics names counter families without the _total suffix which
+	// is only carried by the samples.
+	name, sample := f.name, f.name
+	if openMetrics && f.typ == "counter" {
+		name = strings.TrimSuffix(f.name, "_total")
+		sample = name + "_total"
+	}
+	if f.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(f.help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, f.typ)
+	for _, s := range series {
+		switch f.typ {
+		case "counter":
+			writeSample(w, sample, f.labels, s.values, "", "", loadFloat(&s.value))
+		case "gauge":
+			writeSample(w, f.name, f.labels, s.values, "", "", loadFloat(&s.value))
+		case "histogram":
+			var cum uint64
+			for i, b := range f.buckets {
+				cum += atomic.LoadUint64(&s.counts[i])
+				writeSample(w, f.name+"_bucket", f.labels, s.values, "le", formatFloat(b), float64(cum))
+			}
+			count := atomic.LoadUint64(&s.count)
+			writeSample(w, f.name+"_bucket", f.labels, s.values, "le", "+Inf", float64(count))
+			writeSample(w, f.name+"_sum", f.labels, s.values, "", "", loadFloat(&s.value))
+			writeSample(w, f.name+"_count", f.labels, s.values, "", "", float64(count))
+		}
+	}
+}
+
+func loadFloat(addr *uint64) float64 {
+	return math.Float64frombits(atomic.LoadUint64(addr))
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(values[i]))
+			w.WriteByte('"')
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel)
+			w.WriteString(`="`)
+			w.WriteString(extraValue)
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,90 @@
+package xhandler
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("requests_total", "Total requests.", "code").With("200").Add(3)
+	reg.Gauge("temperature", "Line\nbreak \\ help.").With().Set(-1.5)
+	h := reg.Histogram("latency_seconds", "", []float64{1, 0.1}, "path").With(`a"b`)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, reg.Write(out, false))
+	assert.Equal(t, `# TYPE latency_seconds histogram
+latency_seconds_bucket{path="a\"b",le="0.1"} 1
+latency_seconds_bucket{path="a\"b",le="1"} 2
+latency_seconds_bucket{path="a\"b",le="+Inf"} 3
+latency_seconds_sum{path="a\"b"} 5.55
+latency_seconds_count{path="a\"b"} 3
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+# HELP temperature Line\nbreak \\ help.
+# TYPE temperature gauge
+temperature -1.5
+`, out.String())
+}
+
+func TestRegistryOpenMetrics(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("requests_total", "Total requests.").With().Inc()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	reg.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, contentTypeOpenMetrics, w.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP requests Total requests.
+# TYPE requests counter
+requests_total 1
+# EOF
+`, w.Body.String())
+}
+
+func TestRegistryMaxSeries(t *testing.T) {
+	reg := NewRegistry()
+	reg.MaxSeries = 2
+	c := reg.Counter("hits_total", "", "user")
+	c.With("a").Inc()
+	c.With("b").Inc()
+	c.With("c").Inc()
+	c.With("d").Inc()
+	c.With("a").Inc()
+	assert.Equal(t, 2.0, c.With("a").Value())
+	assert.Equal(t, 2.0, c.With(OverflowLabel).Value())
+	assert.Len(t, c.f.series, 3)
+}
+
+func TestRegistryRedefinition(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("x_total", "")
+	assert.NotPanics(t, func() { reg.Counter("x_total", "") })
+	assert.Panics(t, func() { reg.Gauge("x_total", "") })
+	assert.Panics(t, func() { reg.Counter("x_total", "").With("extra") })
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.Histogram("h", "", []float64{1, 2, 4}).With()
+	assert.True(t, math.IsNaN(h.Quantile(.5)))
+	for _, v := range []float64{0.5, 1.5, 1.5, 3} {
+		h.Observe(v)
+	}
+	assert.Equal(t, 1.0, h.Quantile(.25))
+	assert.Equal(t, 1.5, h.Quantile(.5))
+	assert.Equal(t, 4.0, h.Quantile(1))
+	h.Observe(10)
+	assert.Equal(t, 4.0, h.Quantile(1), "+Inf bucket is capped to the highest bound")
+}
@@ -0,0 +1,158 @@
+package xhandler
+
+import (
+	"crypto/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"context"
+)
+
+type requestIDCtxKey struct{}
+
+// RequestIDKey is the context key of the request ID stored by
+// RequestIDHandler, to be listed in the ContextKeys of RecoverOptions,
+// SlowOptions or PprofOptions. Use RequestIDFromContext to read it.
+var RequestIDKey interface{} = requestIDCtxKey{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, RequestIDKey, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx, or an empty
+// string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey).(string)
+	return id
+}
+
+// RequestIDOptions configures RequestIDHandler.
+type RequestIDOptions struct {
+	// Header is the request header the ID is read from and the response
+	// header it is echoed in. Defaults to X-Request-Id.
+	Header string
+	// Validate tells if an incoming ID is acceptable. Defaults to
+	// ValidRequestID. Return false to always generate IDs, when the
+	// callers are not trusted.
+	Validate func(id string) bool
+	// Generate returns a new ID. Defaults to NewRequestID.
+	Generate func() string
+}
+
+// RequestIDHandler returns a handler giving an ID to each request: the one
+// sent by the caller if valid, a generated one otherwise. The ID is stored
+// in the context (see RequestIDFromContext) and set in the response header.
+// Use RequestIDTransport to propagate it to called services.
+func RequestIDHandler(o RequestIDOptions) func(next HandlerC) HandlerC {
+	if o.Header == "" {
+		o.Header = "X-Request-Id"
+	}
+	if o.Validate == nil {
+		o.Validate = ValidRequestID
+	}
+	if o.Generate == nil {
+		o.Generate = NewRequestID
+	}
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(o.Header)
+			if id == "" || !o.Validate(id) {
+				id = o.Generate()
+			}
+			w.Header().Set(o.Header, id)
+			next.ServeHTTPC(WithRequestID(ctx, id), w, r)
+		})
+	}
+}
+
+// RequestIDTransport returns a middleware setting the request ID of the
+// request context in the header name of outgoing requests. The header
+// defaults to X-Request-Id.
+func RequestIDTransport(name string) func(next http.RoundTripper) http.RoundTripper {
+	if name == "" {
+		name = "X-Request-Id"
+	}
+	return HeaderTransport(name, RequestIDFromContext)
+}
+
+// ValidRequestID tells if id is an acceptable incoming request ID: 1 to 128
+// ASCII letters, digits or any of "-_.:+=/", which covers UUIDs, ULIDs and
+// the base64 encoded IDs of common proxies while keeping log injection out.
+func ValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '+', c == '=', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var requestIDGen struct {
+	mu   sync.Mutex
+	ms   int64
+	rand [10]byte
+}
+
+// NewRequestID returns a new ULID: a 26 characters ID made of a millisecond
+// timestamp followed by 80 random bits. IDs sort lexicographically by
+// creation time, including those created in the same millisecond by this
+// process, whose random part is incremented.
+func NewRequestID() string {
+	g := &requestIDGen
+	g.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms <= g.ms {
+		// Same (or earlier, if the clock went back) millisecond: keep
+		// monotonicity by incrementing the random part
+		ms = g.ms
+		for i := len(g.rand) - 1; i >= 0; i-- {
+			g.rand[i]++
+			if g.rand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		g.ms = ms
+		rand.Read(g.rand[:])
+	}
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(b[6:], g.rand[:])
+	g.mu.Unlock()
+	return encodeULID(b)
+}
+
+// encodeULID encodes the 128 bits of b in 26 base32 characters, the first
+// one holding the 3 most significant bits.
+func encodeULID(b [16]byte) string {
+	var out [26]byte
+	// Process the 130 bit padded value 5 bits at a time from the end
+	var acc uint32
+	bits := 0
+	j := len(out) - 1
+	for i := len(b) - 1; i >= 0; i-- {
+		acc |= uint32(b[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[j] = crockford[acc&31]
+			j--
+			acc >>= 5
+			bits -= 5
+		}
+	}
+	out[0] = crockford[acc&31]
+	return string(out[:])
+}
@@ -0,0 +1,134 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var got string
+	h := RequestIDHandler(RequestIDOptions{})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		got = RequestIDFromContext(ctx)
+	}))
+	serve := func(id string) string {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set("X-Request-Id", id)
+		}
+		h.ServeHTTPC(context.Background(), w, r)
+		assert.Equal(t, got, w.Header().Get("X-Request-Id"))
+		return got
+	}
+	assert.Equal(t, "f47ac10b-58cc-4372-a567-0e02b2c3d479", serve("f47ac10b-58cc-4372-a567-0e02b2c3d479"))
+	assert.Len(t, serve(""), 26)
+	assert.Len(t, serve("bad id\r\nX-Injected: 1"), 26)
+	assert.Len(t, serve(strings.Repeat("a", 129)), 26)
+}
+
+func TestRequestIDHandlerOptions(t *testing.T) {
+	var got string
+	h := RequestIDHandler(RequestIDOptions{
+		Header:   "X-Trace-Id",
+		Validate: func(id string) bool { return false },
+		Generate: func() string { return "generated" },
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		got = RequestIDFromContext(ctx)
+	}))
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Trace-Id", "from-client")
+	h.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, "generated", got)
+	assert.Equal(t, "generated", w.Header().Get("X-Trace-Id"))
+	assert.Equal(t, "", RequestIDFromContext(context.Background()))
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"01ARZ3NDEKTSV4RRFFQ69G5FAV":           true,
+		"f47ac10b-58cc-4372-a567-0e02b2c3d479": true,
+		"Root=1-5759e988-bd862e3fe1be46a9":     true,
+		"aGVsbG8/d29ybGQ+PQ==":                 true,
+		"a_b.c:d":                              true,
+		"":                                     false,
+		"with space":                           false,
+		"new\nline":                            false,
+		"quote\"":                              false,
+		"héhé":                                 false,
+		strings.Repeat("x", 128):               true,
+		strings.Repeat("x", 129):               false,
+	} {
+		assert.Equal(t, want, ValidRequestID(id), id)
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	before := time.Now().UnixMilli()
+	var mu sync.Mutex
+	var ids []string
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := NewRequestID()
+				mu.Lock()
+				ids = append(ids, id)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for _, id := range ids {
+		assert.Len(t, id, 26)
+		assert.True(t, ValidRequestID(id))
+		assert.False(t, seen[id], "duplicate %s", id)
+		seen[id] = true
+	}
+
+	// IDs generated in sequence are sorted
+	seq := make([]string, 1000)
+	for i := range seq {
+		seq[i] = NewRequestID()
+	}
+	assert.True(t, sort.StringsAreSorted(seq))
+
+	// The timestamp prefix decodes to the creation time
+	var ms int64
+	for _, c := range seq[0][:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	assert.True(t, ms >= before && ms <= time.Now().UnixMilli(), "timestamp %d", ms)
+}
+
+func TestEncodeULID(t *testing.T) {
+	var b [16]byte
+	assert.Equal(t, "00000000000000000000000000", encodeULID(b))
+	for i := range b {
+		b[i] = 0xff
+	}
+	assert.Equal(t, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ", encodeULID(b))
+	// Timestamp example of the ULID specification
+	b = [16]byte{0x01, 0x56, 0x3d, 0xf3, 0x64, 0x81}
+	assert.Equal(t, "01ARYZ6S410000000000000000", encodeULID(b))
+}
+
+func TestRequestIDTransport(t *testing.T) {
+	rt := &recordTransport{status: 200}
+	client := TransportChain{RequestIDTransport("")}.Client(&http.Client{Transport: rt})
+	req, _ := http.NewRequest("GET", "http://backend/", nil)
+	client.Do(req.WithContext(WithRequestID(context.Background(), "abc")))
+	assert.Equal(t, "abc", rt.last.Header.Get("X-Request-Id"))
+}
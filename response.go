@@ -0,0 +1,159 @@
+package xhandler
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// responseWriter wraps an http.ResponseWriter to record the status code and
+// the number of bytes written by sub handlers. It forwards the optional
+// Flusher, CloseNotifier and Hijacker interfaces so it does not break
+// middleware further down the chain (like CloseHandler).
+type responseWriter struct {
+	http.ResponseWriter
+	status       int
+	size         int64
+	wroteHeader  bool
+	forceStatus  int
+	beforeHeader []func(code int)
+	panic        *handlerPanic
+}
+
+// handlerPanic is a panic going up the chain, recorded with the stack of
+// the handler which raised it.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// failed tells if the request failed because of the panic. A nil panic or
+// http.ErrAbortHandler, which deliberately aborts the response, does not
+// count as a server error.
+func (p *handlerPanic) failed() bool {
+	return p != nil && p.value != http.ErrAbortHandler
+}
+
+// wrapWriter returns w as a *responseWriter, wrapping it only if it is not
+// already one so several middleware can share the same recorder.
+func wrapWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+// Status returns the status code sent to the client, http.StatusOK if the
+// handler wrote a body without calling WriteHeader or 0 if nothing was sent.
+func (w *responseWriter) Status() int {
+	return w.status
+}
+
+// Size returns the number of body bytes written so far.
+func (w *responseWriter) Size() int64 {
+	return w.size
+}
+
+// BeforeHeader registers f to be called with the final status code right
+// before the response headers are sent, so it can still alter them. It is
+// not called if the handler returns without writing anything.
+func (w *responseWriter) BeforeHeader(f func(code int)) {
+	w.beforeHeader = append(w.beforeHeader, f)
+}
+
+// ForceStatus makes the response be sent with code whatever the status
+// written by the handler.
+func (w *responseWriter) ForceStatus(code int) {
+	w.forceStatus = code
+}
+
+// Written tells if the response headers have been sent.
+func (w *responseWriter) Written() bool {
+	return w.wroteHeader
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Informational responses may be followed by the final one
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.forceStatus != 0 {
+		code = w.forceStatus
+	}
+	w.status = code
+	w.wroteHeader = true
+	for _, f := range w.beforeHeader {
+		f(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// recordPanic returns the panic v with the stack recorded by the first
+// middleware which saw it. It must be called from a deferred function.
+func (w *responseWriter) recordPanic(v interface{}) *handlerPanic {
+	if w.panic == nil {
+		w.panic = &handlerPanic{value: v, stack: debug.Stack()}
+	}
+	return w.panic
+}
+
+// watchPanic is deferred by middleware to observe the outcome of the next
+// handler: f is called with its panic, nil if it returned normally, then
+// the panic goes on.
+func (w *responseWriter) watchPanic(f func(p *handlerPanic)) {
+	v := recover()
+	if v == nil {
+		f(nil)
+		return
+	}
+	f(w.recordPanic(v))
+	panic(v)
+}
+
+// Flush implements http.Flusher.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier. If the underlying writer does
+// not support it, the returned channel never fires.
+func (w *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Hijack implements http.Hijacker.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("xhandler: response writer does not support hijacking")
+}
+
+// Unwrap returns the original writer so http.ResponseController can reach
+// its optional methods.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
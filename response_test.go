@@ -0,0 +1,35 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := wrapWriter(rec)
+	assert.Equal(t, w, wrapWriter(w), "already wrapped writers are reused")
+	assert.False(t, w.Written())
+	w.Write([]byte("foo"))
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("bar"))
+	assert.True(t, w.Written())
+	assert.Equal(t, http.StatusOK, w.Status())
+	assert.Equal(t, int64(6), w.Size())
+	assert.Equal(t, rec, w.Unwrap())
+}
+
+func TestResponseWriterCloseNotify(t *testing.T) {
+	cn := &closeNotifyWriter{ResponseRecorder: httptest.NewRecorder(), closed: true}
+	w := wrapWriter(cn)
+	select {
+	case <-w.CloseNotify():
+	default:
+		t.Error("close notification not forwarded")
+	}
+	_, _, err := w.Hijack()
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package xhandler
+
+import (
+	"net/http"
+	"runtime/trace"
+
+	"context"
+)
+
+type runtimeTaskCtxKey struct{}
+
+// RuntimeTraceHandler creates a runtime/trace task for each request,
+// annotated with the request method and path, so requests show up in
+// go tool trace. The task is stored in the context passed to sub handlers
+// which can log annotated events with trace.Log(ctx, category, message) or
+// retrieve it with RuntimeTraceTask.
+//
+// Tasks are only created while a trace is being recorded (see
+// trace.IsEnabled), so the overhead is negligible otherwise.
+func RuntimeTraceHandler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !trace.IsEnabled() {
+			next.ServeHTTPC(ctx, w, r)
+			return
+		}
+		ctx, task := trace.NewTask(ctx, "HTTP "+r.Method)
+		defer task.End()
+		trace.Log(ctx, "http.method", r.Method)
+		trace.Log(ctx, "http.path", r.URL.Path)
+		next.ServeHTTPC(context.WithValue(ctx, runtimeTaskCtxKey{}, task), w, r)
+	})
+}
+
+// RuntimeTraceHook is a StageHook wrapping each chain stage and the final
+// handler in a runtime/trace region named after the stage. Pass it to
+// Chain.Instrument along with RuntimeTraceHandler at the top of the chain
+// so regions are attached to the request task.
+func RuntimeTraceHook(s Stage, h HandlerC) HandlerC {
+	name := s.String()
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !trace.IsEnabled() {
+			h.ServeHTTPC(ctx, w, r)
+			return
+		}
+		trace.WithRegion(ctx, name, func() {
+			h.ServeHTTPC(ctx, w, r)
+		})
+	})
+}
+
+// RuntimeTraceTask returns the runtime/trace task of the request or nil if
+// none was created.
+func RuntimeTraceTask(ctx context.Context) *trace.Task {
+	t, _ := ctx.Value(runtimeTaskCtxKey{}).(*trace.Task)
+	return t
+}
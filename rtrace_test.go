@@ -0,0 +1,37 @@
+package xhandler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime/trace"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeTrace(t *testing.T) {
+	var task *trace.Task
+	c := Chain{}
+	c.UseC(RuntimeTraceHandler)
+	c.UseC(CloseHandler)
+	h := c.Instrument(RuntimeTraceHook).HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		task = RuntimeTraceTask(ctx)
+		trace.Log(ctx, "handler", "called")
+	})
+
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.Nil(t, task, "no task is created when tracing is disabled")
+
+	buf := &bytes.Buffer{}
+	if err := trace.Start(buf); err != nil {
+		t.Skip("tracing already enabled")
+	}
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	trace.Stop()
+	assert.NotNil(t, task)
+	assert.Contains(t, buf.String(), "HTTP GET")
+	assert.Contains(t, buf.String(), "1:xhandler.CloseHandler")
+}
@@ -0,0 +1,257 @@
+package xhandler
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"context"
+)
+
+// ErrServerShutdown is the cause of the root context (and thus of the
+// contexts of requests still running) canceled by Server.Shutdown.
+var ErrServerShutdown = errors.New("xhandler: server shutdown")
+
+// Server serves a chain with a graceful shutdown: on SIGTERM (or SIGINT) it
+// stops accepting connections, lets in-flight requests complete during a
+// grace period, then cancels the root context (with ErrServerShutdown as
+// cause) and waits for the remaining requests and background goroutines
+// until a hard deadline.
+//
+// The root context, available with Context, is the one passed to
+// Chain.HandlerCtx so all request contexts derive from it; derive
+// background work from it too so it stops on shutdown. It carries the
+// Background group, so handlers can start work outliving their request
+// with GoBackground.
+type Server struct {
+	// HTTP is the underlying server. Its fields (timeouts, TLS config...)
+	// may be customized before calling ListenAndServe or Serve but its
+	// Handler must be left untouched.
+	HTTP *http.Server
+	// DrainDelay is the time the server keeps accepting requests once the
+	// shutdown started, while reporting itself as draining (see Health),
+	// so load balancers stop routing traffic to it first. Defaults to 0.
+	DrainDelay time.Duration
+	// GracePeriod is the time given to in-flight requests to complete once
+	// the listeners are closed, before their contexts are canceled. Defaults to
+	// 15s.
+	GracePeriod time.Duration
+	// ShutdownTimeout is the hard deadline of the shutdown started by a
+	// signal, after which remaining connections are forcibly closed.
+	// Defaults to 25s.
+	ShutdownTimeout time.Duration
+	// Signals starting the shutdown. Defaults to SIGTERM and SIGINT.
+	Signals []os.Signal
+	// Background is the group of goroutines started with GoBackground,
+	// bound to the root context and waited for by Shutdown. Its fields may
+	// be customized but it must not be replaced.
+	Background *BackgroundGroup
+
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	inflight activeCount
+	draining int32
+	once     sync.Once
+	drained  chan struct{}
+}
+
+// NewServer creates a server listening on addr and serving h wrapped by the
+// chain c.
+func NewServer(addr string, c Chain, h HandlerC) *Server {
+	s := &Server{
+		GracePeriod:     15 * time.Second,
+		ShutdownTimeout: 25 * time.Second,
+		Signals:         []os.Signal{syscall.SIGTERM, os.Interrupt},
+		drained:         make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	s.Background = NewBackgroundGroup(s.ctx, 0)
+	s.ctx = WithBackgroundGroup(s.ctx, s.Background)
+	handler := c.HandlerCtx(s.ctx, h)
+	s.HTTP = &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.inflight.add(1)
+			defer s.inflight.add(-1)
+			if s.Draining() {
+				// Requests received on keep-alive connections during the
+				// shutdown are served but their connection is closed
+				w.Header().Set("Connection", "close")
+			}
+			handler.ServeHTTP(w, r)
+		}),
+	}
+	return s
+}
+
+// Context returns the root context of the server, canceled when the
+// shutdown grace period expires or the server is stopped.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// Draining tells if the shutdown started.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// DrainStarted returns a channel closed when the shutdown starts.
+func (s *Server) DrainStarted() <-chan struct{} {
+	return s.drained
+}
+
+// InFlight returns the number of requests being served.
+func (s *Server) InFlight() int {
+	return s.inflight.count()
+}
+
+// ListenAndServe listens on the server address and serves requests until a
+// shutdown signal is received and the server is drained. It returns nil
+// after a graceful shutdown.
+func (s *Server) ListenAndServe() error {
+	addr := s.HTTP.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves requests on l until a shutdown signal is received and the
+// server is drained. It returns nil after a graceful shutdown. If Shutdown
+// is called by other means, Serve returns http.ErrServerClosed immediately
+// like http.Server.Serve.
+func (s *Server) Serve(l net.Listener) error {
+	sig := make(chan os.Signal, 1)
+	if len(s.Signals) > 0 {
+		signal.Notify(sig, s.Signals...)
+		defer signal.Stop(sig)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.HTTP.Serve(l)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-sig:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+	<-errc
+	return nil
+}
+
+// Shutdown gracefully stops the server: after DrainDelay, listeners are
+// closed, in-flight requests are given GracePeriod to complete before the
+// root context is canceled, and Shutdown waits for them and for the
+// Background goroutines until ctx expires, in which case the remaining
+// connections are closed and the ctx error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(func() {
+		atomic.StoreInt32(&s.draining, 1)
+		close(s.drained)
+	})
+	if s.DrainDelay > 0 {
+		select {
+		case <-time.After(s.DrainDelay):
+		case <-ctx.Done():
+		}
+	}
+	grace := time.AfterFunc(s.GracePeriod, func() {
+		s.cancel(ErrServerShutdown)
+	})
+	defer grace.Stop()
+	defer s.cancel(ErrServerShutdown)
+
+	err := s.HTTP.Shutdown(ctx)
+	if err == nil {
+		// Hijacked connections are not tracked by http.Server
+		err = s.waitIdle(ctx)
+	}
+	if err == nil {
+		err = s.Background.Wait(ctx)
+	}
+	if err != nil {
+		s.cancel(ErrServerShutdown)
+		s.HTTP.Close()
+	}
+	return err
+}
+
+func (s *Server) waitIdle(ctx context.Context) error {
+	return s.inflight.wait(ctx)
+}
+
+// activeCount counts running tasks and lets callers wait for none to be
+// left.
+type activeCount struct {
+	mu sync.Mutex
+	n  int
+	// idle is closed when n drops to 0, nil while it is 0
+	idle chan struct{}
+}
+
+func (c *activeCount) add(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(delta)
+}
+
+// tryAdd adds one to the count unless it reached max. A max of 0 means no
+// limit.
+func (c *activeCount) tryAdd(max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.n >= max {
+		return false
+	}
+	c.addLocked(1)
+	return true
+}
+
+func (c *activeCount) addLocked(delta int) {
+	if c.n == 0 && delta > 0 {
+		c.idle = make(chan struct{})
+	}
+	c.n += delta
+	if c.n == 0 {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+func (c *activeCount) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// wait waits for the count to drop to 0, or until ctx expires in which case
+// the ctx error is returned.
+func (c *activeCount) wait(ctx context.Context) error {
+	c.mu.Lock()
+	idle := c.idle
+	c.mu.Unlock()
+	if idle == nil {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,162 @@
+package xhandler
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestServer(t *testing.T, s *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(l)
+	}()
+	return "http://" + l.Addr().String(), errc
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	s := NewServer("", Chain{}, HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-ctx.Done()
+		cause <- context.Cause(ctx)
+		w.Write([]byte("interrupted"))
+	}))
+	s.GracePeriod = 20 * time.Millisecond
+	s.Signals = nil
+	url, errc := startTestServer(t, s)
+
+	res := make(chan string)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			res <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		res <- string(b)
+	}()
+	<-started
+	assert.Equal(t, 1, s.InFlight())
+	assert.False(t, s.Draining())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.True(t, s.Draining())
+	assert.Equal(t, ErrServerShutdown, <-cause)
+	assert.Equal(t, "interrupted", <-res)
+	assert.Equal(t, http.ErrServerClosed, <-errc)
+	assert.Equal(t, ErrServerShutdown, context.Cause(s.Context()))
+	select {
+	case <-s.DrainStarted():
+	default:
+		t.Error("drain channel not closed")
+	}
+}
+
+func TestServerHardDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := NewServer("", Chain{}, HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer close(release)
+	s.GracePeriod = 10 * time.Millisecond
+	s.Signals = nil
+	url, _ := startTestServer(t, s)
+	go http.Get(url)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+}
+
+func TestServerSignal(t *testing.T) {
+	s := NewServer("", Chain{}, HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {}))
+	s.Signals = []os.Signal{syscall.SIGUSR1}
+	url, errc := startTestServer(t, s)
+	resp, err := http.Get(url)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	select {
+	case err := <-errc:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop")
+	}
+	assert.True(t, s.Draining())
+}
+
+func TestServerShutdownWaitsBackground(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	s := NewServer("", Chain{}, HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		GoBackground(ctx, func(ctx context.Context) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			done <- context.Cause(ctx)
+		})
+	}))
+	s.GracePeriod = 50 * time.Millisecond
+	s.Signals = nil
+	url, _ := startTestServer(t, s)
+	resp, err := http.Get(url)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+	assert.Equal(t, 1, s.Background.Running())
+
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.Equal(t, 0, s.Background.Running())
+	assert.NoError(t, <-done, "completed within the grace period")
+}
+
+func TestActiveCount(t *testing.T) {
+	var c activeCount
+	assert.NoError(t, c.wait(context.Background()))
+	c.add(1)
+	c.add(1)
+	assert.Equal(t, 2, c.count())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c.wait(ctx))
+
+	done := make(chan error)
+	go func() {
+		done <- c.wait(context.Background())
+	}()
+	c.add(-1)
+	c.add(-1)
+	assert.NoError(t, <-done)
+	c.add(1)
+	assert.Equal(t, 1, c.count(), "reusable once idle")
+
+	assert.False(t, c.tryAdd(1))
+	assert.True(t, c.tryAdd(2))
+	assert.True(t, c.tryAdd(0))
+	assert.Equal(t, 3, c.count())
+}
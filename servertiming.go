@@ -0,0 +1,178 @@
+package xhandler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// ServerTiming is a middleware emitting the timing entries collected during
+// a request in a Server-Timing response header, so they show up in the
+// browser developer tools.
+//
+// Entries are added by handlers using AddServerTiming or StartServerTiming
+// and, if the Hook method is passed to Chain.Instrument, for each chain
+// stage (named after the stage function) with the time spent in the stage
+// before calling the next one.
+//
+// As timings may reveal internals, only the entries listed in Allowlist are
+// sent unless the Trusted function reports the client as trusted.
+type ServerTiming struct {
+	// Allowlist lists the entry names sent to all clients.
+	Allowlist []string
+	// Trusted reports if all the entries can be sent to the client of r,
+	// for instance based on its IP or an authenticated user in ctx.
+	Trusted func(ctx context.Context, r *http.Request) bool
+	// Trailer, if set, sends the entries added after the response headers
+	// have been sent (streamed responses) in a Server-Timing trailer.
+	Trailer bool
+}
+
+type serverTimingCtxKey struct{}
+
+type timingEntry struct {
+	name string
+	desc string
+	dur  time.Duration
+}
+
+type stageEnter struct {
+	name string
+	at   time.Time
+}
+
+// serverTiming collects the timing entries of a request.
+type serverTiming struct {
+	mu      sync.Mutex
+	allow   func(name string) bool
+	stages  []stageEnter
+	entries []timingEntry
+	sent    int
+}
+
+func (st *serverTiming) add(e timingEntry) {
+	st.mu.Lock()
+	st.entries = append(st.entries, e)
+	st.mu.Unlock()
+}
+
+var quotedStringReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// header formats the entries not sent yet. If withStages is true, the
+// chain stage timings are included, measured until now for the last one.
+func (st *serverTiming) header(withStages bool) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var entries []timingEntry
+	if withStages {
+		now := time.Now()
+		for i, s := range st.stages {
+			end := now
+			if i+1 < len(st.stages) {
+				end = st.stages[i+1].at
+			}
+			entries = append(entries, timingEntry{name: s.name, dur: end.Sub(s.at)})
+		}
+	}
+	entries = append(entries, st.entries[st.sent:]...)
+	st.sent = len(st.entries)
+	var b strings.Builder
+	for _, e := range entries {
+		if !st.allow(e.name) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(e.name)
+		b.WriteString(";dur=")
+		b.WriteString(strconv.FormatFloat(float64(e.dur)/float64(time.Millisecond), 'f', -1, 64))
+		if e.desc != "" {
+			b.WriteString(`;desc="`)
+			b.WriteString(quotedStringReplacer.Replace(e.desc))
+			b.WriteByte('"')
+		}
+	}
+	return b.String()
+}
+
+// AddServerTiming adds a timing entry to be sent in the Server-Timing header.
+// The name should be a token: spaces and separators are replaced with
+// underscores. It is a no-op if the ServerTiming middleware is not installed.
+func AddServerTiming(ctx context.Context, name, desc string, d time.Duration) {
+	if st, ok := ctx.Value(serverTimingCtxKey{}).(*serverTiming); ok {
+		st.add(timingEntry{name: timingName(name), desc: desc, dur: d})
+	}
+}
+
+// StartServerTiming starts measuring a timing entry and returns the
+// function to call to stop the measure and add it to the request timings.
+func StartServerTiming(ctx context.Context, name string) (stop func()) {
+	start := time.Now()
+	return func() {
+		AddServerTiming(ctx, name, "", time.Since(start))
+	}
+}
+
+// Handler implements the middleware.
+func (o *ServerTiming) Handler(next HandlerC) HandlerC {
+	allowed := map[string]bool{}
+	for _, n := range o.Allowlist {
+		allowed[timingName(n)] = true
+	}
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		st := &serverTiming{allow: func(name string) bool { return allowed[name] }}
+		if o.Trusted != nil && o.Trusted(ctx, r) {
+			st.allow = func(string) bool { return true }
+		}
+		rw := wrapWriter(w)
+		rw.BeforeHeader(func(int) {
+			if v := st.header(true); v != "" {
+				rw.Header().Add("Server-Timing", v)
+			}
+		})
+		next.ServeHTTPC(context.WithValue(ctx, serverTimingCtxKey{}, st), rw, r)
+		if !rw.Written() {
+			// Nothing written, headers are still ours
+			if v := st.header(true); v != "" {
+				rw.Header().Add("Server-Timing", v)
+			}
+		} else if o.Trailer {
+			if v := st.header(false); v != "" {
+				rw.Header().Add(http.TrailerPrefix+"Server-Timing", v)
+			}
+		}
+	})
+}
+
+// Hook is a StageHook recording, for each chain stage, the time spent
+// before the next stage is entered. Stages placed before the ServerTiming
+// middleware in the chain are not recorded.
+func (o *ServerTiming) Hook(s Stage, h HandlerC) HandlerC {
+	name := timingName(s.Name)
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if st, ok := ctx.Value(serverTimingCtxKey{}).(*serverTiming); ok {
+			st.mu.Lock()
+			st.stages = append(st.stages, stageEnter{name: name, at: time.Now()})
+			st.mu.Unlock()
+		}
+		h.ServeHTTPC(ctx, w, r)
+	})
+}
+
+// timingName turns a stage or entry name into a valid header token.
+func timingName(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if isTokenChar(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
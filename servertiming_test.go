@@ -0,0 +1,86 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTiming(t *testing.T) {
+	st := &ServerTiming{Allowlist: []string{"db", "xhandler.CloseHandler"}}
+	c := Chain{}
+	c.UseC(st.Handler)
+	c.UseC(CloseHandler)
+	h := c.Instrument(st.Hook).HandlerCF(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AddServerTiming(ctx, "db", `query "users"`, 1500*time.Microsecond)
+		AddServerTiming(ctx, "secret", "", time.Millisecond)
+		w.Write([]byte("ok"))
+		AddServerTiming(ctx, "db", "late", time.Millisecond)
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	v := w.Header().Get("Server-Timing")
+	assert.Regexp(t, regexp.MustCompile(`^xhandler\.CloseHandler;dur=[0-9.]+, db;dur=1\.5;desc="query \\"users\\""$`), v)
+	assert.Empty(t, w.Header().Get(http.TrailerPrefix+"Server-Timing"))
+}
+
+func TestServerTimingTrustedTrailer(t *testing.T) {
+	st := &ServerTiming{
+		Trusted: func(ctx context.Context, r *http.Request) bool { return true },
+		Trailer: true,
+	}
+	h := st.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		stop := StartServerTiming(ctx, "render")
+		stop()
+		w.(http.Flusher).Flush()
+		AddServerTiming(ctx, "stream", "", 2*time.Millisecond)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	assert.Regexp(t, `^render;dur=[0-9.]+$`, w.Header().Get("Server-Timing"))
+	assert.Equal(t, "stream;dur=2", w.Header().Get(http.TrailerPrefix+"Server-Timing"))
+}
+
+func TestServerTimingNoWrite(t *testing.T) {
+	st := &ServerTiming{Allowlist: []string{"a"}}
+	h := st.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AddServerTiming(ctx, "a", "", time.Millisecond)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, "a;dur=1", w.Header().Get("Server-Timing"))
+
+	// Helpers are no-ops without the middleware
+	AddServerTiming(context.Background(), "a", "", time.Millisecond)
+	StartServerTiming(context.Background(), "a")()
+}
+
+func TestServerTimingInvalidName(t *testing.T) {
+	st := &ServerTiming{Allowlist: []string{"db query"}}
+	h := st.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AddServerTiming(ctx, "db query", "", time.Millisecond)
+		AddServerTiming(ctx, "a;b,c", "", time.Millisecond)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, "db_query;dur=1", w.Header().Get("Server-Timing"))
+
+	st.Allowlist = append(st.Allowlist, "a;b,c")
+	h = st.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		AddServerTiming(ctx, "a;b,c", "", time.Millisecond)
+	}))
+	w = httptest.NewRecorder()
+	h.ServeHTTPC(context.Background(), w, testRequest)
+	assert.Equal(t, "a_b_c;dur=1", w.Header().Get("Server-Timing"))
+}
+
+func TestTimingName(t *testing.T) {
+	assert.Equal(t, "xhandler._*Chain_.Use.func1", timingName("xhandler.(*Chain).Use.func1"))
+	assert.Equal(t, "_", timingName(""))
+}
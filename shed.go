@@ -0,0 +1,260 @@
+package xhandler
+
+import (
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"context"
+)
+
+// Priority is the importance class of a request, using the RFC 9218 urgency
+// scale: from 0 (most important) to 7 (least important).
+type Priority int
+
+// Priority classes.
+const (
+	PriorityCritical   Priority = 0
+	PriorityDefault    Priority = 3
+	PriorityBackground Priority = 7
+)
+
+type priorityCtxKey struct{}
+
+// WithPriority returns a copy of ctx carrying the priority p. A priority set
+// before LoadShedder.Handler takes precedence over its matcher.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityCtxKey{}, p)
+}
+
+// PriorityFromContext returns the priority stored in ctx, if any.
+func PriorityFromContext(ctx context.Context) (Priority, bool) {
+	p, ok := ctx.Value(priorityCtxKey{}).(Priority)
+	return p, ok
+}
+
+// ParsePriority parses the urgency parameter of an RFC 9218 Priority header
+// (e.g. "u=5, i"). Unknown or invalid parameters are ignored as mandated by
+// the RFC; ok is false if no valid urgency is found.
+func ParsePriority(header string) (p Priority, ok bool) {
+	for _, item := range strings.Split(header, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.HasPrefix(item, "u=") {
+			continue
+		}
+		u, err := strconv.Atoi(item[2:])
+		if err != nil || u < 0 || u > 7 {
+			continue
+		}
+		p, ok = Priority(u), true
+	}
+	return p, ok
+}
+
+// ShedOptions configures a LoadShedder. Each signal is disabled when its
+// maximum is zero.
+type ShedOptions struct {
+	// Priority returns the priority class of a request. If nil or if it
+	// returns false, PriorityDefault is used. A lower priority requested
+	// by the client with the Priority header is honored, a higher one is
+	// not so clients can't promote their own requests.
+	Priority func(ctx context.Context, r *http.Request) (Priority, bool)
+	// MaxInFlight is the number of concurrent requests at which requests of
+	// all classes are shed.
+	MaxInFlight int
+	// MaxQueueTime is the time spent by requests in upstream queues (see
+	// QueueTime) at which requests of all classes are shed.
+	MaxQueueTime time.Duration
+	// QueueTime returns the time r waited before being handled. Defaults
+	// to the age of the X-Request-Start header set by load balancers.
+	QueueTime func(r *http.Request) time.Duration
+	// MaxCPU is the CPU utilization, from 0 to 1, at which requests of all
+	// classes are shed.
+	MaxCPU float64
+	// CPU returns the current CPU utilization. Defaults to the utilization
+	// of the process GOMAXPROCS measured by a CPUSampler.
+	CPU func() float64
+	// Reserve is the share of each maximum reserved to more important
+	// classes: PriorityBackground requests are shed as soon as a signal
+	// reaches (1-Reserve) of its maximum, PriorityCritical ones only at the
+	// maximum, with a linear scale in between. Defaults to 0.5.
+	Reserve float64
+	// RetryAfter is the delay advertised in the Retry-After header of shed
+	// requests. Defaults to 1s.
+	RetryAfter time.Duration
+	// Registry, if set, receives a shed_requests_total counter labelled by
+	// priority and signal.
+	Registry *Registry
+}
+
+// LoadShedder rejects requests of the least important priority classes
+// first when the service is overloaded, according to the in-flight count,
+// queue time and CPU utilization signals. Shed requests get a 503 Service
+// Unavailable response with a Retry-After header.
+type LoadShedder struct {
+	o        ShedOptions
+	inflight int64
+	shed     *CounterVec
+}
+
+// NewLoadShedder creates a load shedder.
+func NewLoadShedder(o ShedOptions) *LoadShedder {
+	if o.Reserve <= 0 || o.Reserve > 1 {
+		o.Reserve = 0.5
+	}
+	if o.RetryAfter <= 0 {
+		o.RetryAfter = time.Second
+	}
+	if o.QueueTime == nil {
+		o.QueueTime = RequestStartQueueTime
+	}
+	if o.MaxCPU > 0 && o.CPU == nil {
+		o.CPU = (&CPUSampler{}).Utilization
+	}
+	s := &LoadShedder{o: o}
+	if o.Registry != nil {
+		s.shed = o.Registry.Counter("shed_requests_total",
+			"Number of requests shed because of overload.", "priority", "signal")
+	}
+	return s
+}
+
+// Priority resolves the priority of r.
+func (s *LoadShedder) Priority(ctx context.Context, r *http.Request) Priority {
+	if p, ok := PriorityFromContext(ctx); ok {
+		return p
+	}
+	p := PriorityDefault
+	if s.o.Priority != nil {
+		if mp, ok := s.o.Priority(ctx, r); ok {
+			p = mp
+		}
+	}
+	if hp, ok := ParsePriority(r.Header.Get("Priority")); ok && hp > p {
+		p = hp
+	}
+	return p
+}
+
+// threshold returns the share of the signals maximum at which p is shed.
+func (s *LoadShedder) threshold(p Priority) float64 {
+	if p < PriorityCritical {
+		p = PriorityCritical
+	} else if p > PriorityBackground {
+		p = PriorityBackground
+	}
+	return 1 - s.o.Reserve*float64(p)/float64(PriorityBackground)
+}
+
+// check returns the name of the signal requiring r to be shed, if any.
+// inflight includes r.
+func (s *LoadShedder) check(r *http.Request, p Priority, inflight int64) string {
+	t := s.threshold(p)
+	if s.o.MaxInFlight > 0 && float64(inflight) > t*float64(s.o.MaxInFlight) {
+		return "in_flight"
+	}
+	if s.o.MaxQueueTime > 0 && float64(s.o.QueueTime(r)) >= t*float64(s.o.MaxQueueTime) {
+		return "queue_time"
+	}
+	if s.o.MaxCPU > 0 && s.o.CPU() >= t*s.o.MaxCPU {
+		return "cpu"
+	}
+	return ""
+}
+
+// Handler implements the middleware. The resolved priority is stored in the
+// context passed to next.
+func (s *LoadShedder) Handler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		p := s.Priority(ctx, r)
+		inflight := atomic.AddInt64(&s.inflight, 1)
+		defer atomic.AddInt64(&s.inflight, -1)
+		if signal := s.check(r, p, inflight); signal != "" {
+			if s.shed != nil {
+				s.shed.With(strconv.Itoa(int(p)), signal).Inc()
+			}
+			w.Header().Set("Retry-After", retryAfter(s.o.RetryAfter))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTPC(WithPriority(ctx, p), w, r)
+	})
+}
+
+// RequestStartQueueTime returns the time elapsed since the X-Request-Start
+// header timestamp, as set by load balancers like nginx ("t=1700000000.123",
+// in seconds) or Heroku (in milliseconds). It returns 0 if the header is
+// missing or invalid.
+func RequestStartQueueTime(r *http.Request) time.Duration {
+	v := strings.TrimPrefix(r.Header.Get("X-Request-Start"), "t=")
+	if v == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return 0
+	}
+	if d := time.Since(unixTimestamp(f)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// unixTimestamp converts a Unix timestamp in seconds, milliseconds or
+// microseconds, guessed from its magnitude, to a time.
+func unixTimestamp(f float64) time.Time {
+	switch {
+	case f > 1e14: // microseconds
+		return time.UnixMicro(int64(f))
+	case f > 1e11: // milliseconds
+		return time.UnixMilli(int64(f))
+	default:
+		sec := math.Floor(f)
+		return time.Unix(int64(sec), int64(math.Round((f-sec)*1e6))*1e3)
+	}
+}
+
+// CPUSampler measures the CPU utilization of the process relative to the
+// capacity given by GOMAXPROCS, from the process CPU time reported by the
+// operating system. It is always 0 on platforms without getrusage. The zero
+// value is ready to use.
+type CPUSampler struct {
+	// Interval is the minimum time between two measures; calls in between
+	// return the last measure. Defaults to 250ms.
+	Interval time.Duration
+
+	mu   sync.Mutex
+	at   time.Time
+	cpu  time.Duration
+	last float64
+}
+
+// Utilization returns the CPU utilization since the previous measure, from 0
+// to 1. The first call returns 0.
+func (c *CPUSampler) Utilization() float64 {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = 250 * time.Millisecond
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if !c.at.IsZero() && now.Sub(c.at) < interval {
+		return c.last
+	}
+	cpu, ok := processCPUTime()
+	if !ok {
+		return 0
+	}
+	if !c.at.IsZero() {
+		capacity := float64(now.Sub(c.at)) * float64(runtime.GOMAXPROCS(0))
+		c.last = math.Min(math.Max(float64(cpu-c.cpu)/capacity, 0), 1)
+	}
+	c.at, c.cpu = now, cpu
+	return c.last
+}
@@ -0,0 +1,179 @@
+package xhandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePriority(t *testing.T) {
+	for header, want := range map[string]int{
+		"u=5":        5,
+		"u=0, i":     0,
+		"i, u=7":     7,
+		" u=1 ":      1,
+		"u=8":        -1,
+		"u=-1":       -1,
+		"u=a":        -1,
+		"i":          -1,
+		"":           -1,
+		"u=2, u=6":   6,
+		"u=2, u=foo": 2,
+	} {
+		p, ok := ParsePriority(header)
+		if want < 0 {
+			assert.False(t, ok, header)
+			continue
+		}
+		assert.True(t, ok, header)
+		assert.Equal(t, Priority(want), p, header)
+	}
+}
+
+func TestLoadShedderPriority(t *testing.T) {
+	s := NewLoadShedder(ShedOptions{
+		Priority: func(ctx context.Context, r *http.Request) (Priority, bool) {
+			if r.URL.Path == "/checkout" {
+				return PriorityCritical, true
+			}
+			return 0, false
+		},
+	})
+	req := func(path, priority string) *http.Request {
+		r, _ := http.NewRequest("GET", path, nil)
+		if priority != "" {
+			r.Header.Set("Priority", priority)
+		}
+		return r
+	}
+	ctx := context.Background()
+	assert.Equal(t, PriorityDefault, s.Priority(ctx, req("/", "")))
+	assert.Equal(t, PriorityCritical, s.Priority(ctx, req("/checkout", "")))
+	// Clients can lower their priority, not raise it
+	assert.Equal(t, Priority(6), s.Priority(ctx, req("/", "u=6")))
+	assert.Equal(t, PriorityDefault, s.Priority(ctx, req("/", "u=0")))
+	assert.Equal(t, Priority(2), s.Priority(ctx, req("/checkout", "u=2")))
+	// The context value wins
+	assert.Equal(t, PriorityCritical, s.Priority(WithPriority(ctx, PriorityCritical), req("/", "u=7")))
+}
+
+func TestLoadShedderInFlight(t *testing.T) {
+	reg := NewRegistry()
+	s := NewLoadShedder(ShedOptions{MaxInFlight: 8, Registry: reg})
+	var got Priority
+	h := s.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		got, _ = PriorityFromContext(ctx)
+	}))
+	serve := func(urgency int) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		h.ServeHTTPC(WithPriority(context.Background(), Priority(urgency)), w, r)
+		return w.Code
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Priority", "u=7")
+	h.ServeHTTPC(context.Background(), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, Priority(7), got)
+
+	// Background requests are shed above half of the maximum, default ones
+	// above 8*(1-0.5*3/7) = 6.3 and critical ones at the maximum
+	for inflight, want := range map[int64][]int{
+		3: {200, 200, 200},
+		4: {200, 200, 503},
+		6: {200, 503, 503},
+		8: {503, 503, 503},
+	} {
+		atomic.StoreInt64(&s.inflight, inflight)
+		assert.Equal(t, want, []int{serve(0), serve(3), serve(7)}, "in-flight %d", inflight)
+	}
+	atomic.StoreInt64(&s.inflight, 0)
+	shed := reg.Counter("shed_requests_total", "", "priority", "signal")
+	assert.Equal(t, 3.0, shed.With("7", "in_flight").Value())
+	assert.Equal(t, 2.0, shed.With("3", "in_flight").Value())
+	assert.Equal(t, 1.0, shed.With("0", "in_flight").Value())
+}
+
+func TestLoadShedderSignals(t *testing.T) {
+	cpu := 0.0
+	s := NewLoadShedder(ShedOptions{
+		MaxQueueTime: time.Second,
+		MaxCPU:       0.8,
+		CPU:          func() float64 { return cpu },
+		RetryAfter:   3 * time.Second,
+	})
+	h := s.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {}))
+	serve := func(p Priority, queued time.Duration) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if queued > 0 {
+			r.Header.Set("X-Request-Start", "t="+strconv.FormatInt(time.Now().Add(-queued).UnixMicro(), 10))
+		}
+		h.ServeHTTPC(WithPriority(context.Background(), p), w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, serve(PriorityBackground, 0).Code)
+	w := serve(PriorityBackground, 700*time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "3", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve(PriorityCritical, 700*time.Millisecond).Code)
+
+	cpu = 0.5
+	assert.Equal(t, http.StatusServiceUnavailable, serve(PriorityBackground, 0).Code)
+	assert.Equal(t, http.StatusOK, serve(PriorityDefault, 0).Code)
+	cpu = 0.9
+	assert.Equal(t, http.StatusServiceUnavailable, serve(PriorityCritical, 0).Code)
+}
+
+func TestRequestStartQueueTime(t *testing.T) {
+	start := time.Now().Add(-2 * time.Second)
+	for _, v := range []string{
+		fmt.Sprintf("t=%.3f", float64(start.UnixMilli())/1000),
+		strconv.FormatInt(start.UnixMilli(), 10),
+		"t=" + strconv.FormatInt(start.UnixMicro(), 10),
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-Start", v)
+		d := RequestStartQueueTime(r)
+		assert.InDelta(t, 2*time.Second, d, float64(100*time.Millisecond), v)
+	}
+	for _, v := range []string{"", "t=abc", "t=-1", strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-Start", v)
+		assert.Equal(t, time.Duration(0), RequestStartQueueTime(r), v)
+	}
+}
+
+func TestCPUSampler(t *testing.T) {
+	c := &CPUSampler{Interval: time.Millisecond}
+	assert.Equal(t, 0.0, c.Utilization())
+	time.Sleep(5 * time.Millisecond)
+	u := c.Utilization()
+	assert.True(t, u >= 0 && u <= 1, "utilization %f", u)
+}
+
+func TestCPUSamplerBusy(t *testing.T) {
+	c := &CPUSampler{Interval: time.Millisecond}
+	c.Utilization()
+	// Burn CPU without allocating, so no GC runs in between
+	x := 0
+	for start := time.Now(); time.Since(start) < 50*time.Millisecond; {
+		for i := 0; i < 1000; i++ {
+			x += i
+		}
+	}
+	u := c.Utilization()
+	assert.True(t, x != 0)
+	assert.True(t, u > 0.5/float64(runtime.GOMAXPROCS(0)), "utilization %f", u)
+	assert.True(t, u <= 1, "utilization %f", u)
+}
@@ -0,0 +1,236 @@
+package xhandler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// SlowRequest describes a request which exceeded the SlowHandler threshold,
+// captured while it is still running.
+type SlowRequest struct {
+	Method     string
+	URL        string
+	Proto      string
+	RemoteAddr string
+	// Header holds the request headers listed in SlowOptions.Headers.
+	Header  http.Header
+	Start   time.Time
+	Elapsed time.Duration
+	// Values holds the context values listed in SlowOptions.ContextKeys.
+	Values map[string]interface{}
+	// Stack holds the stack traces of the goroutines serving the request
+	// (and of those they started) in the goroutine profile format, or of
+	// all goroutines if SlowOptions.AllGoroutines is set. Goroutines left
+	// running by a previous request may show up too.
+	Stack []byte
+	// Suppressed is the number of dumps dropped by the rate limiter since
+	// the previous one.
+	Suppressed int
+}
+
+// SlowSink receives slow request dumps. It is called from its own goroutine
+// while the request is still being served.
+type SlowSink interface {
+	SlowRequest(ctx context.Context, s SlowRequest)
+}
+
+// SlowSinkFunc is an adapter to allow the use of ordinary functions as
+// SlowSink.
+type SlowSinkFunc func(ctx context.Context, s SlowRequest)
+
+// SlowRequest calls f(ctx, s).
+func (f SlowSinkFunc) SlowRequest(ctx context.Context, s SlowRequest) {
+	f(ctx, s)
+}
+
+// SlowOptions configures SlowHandler.
+type SlowOptions struct {
+	// Threshold is the request duration after which a dump is taken.
+	// Required.
+	Threshold time.Duration
+	// Sink receives the dumps. Required.
+	Sink SlowSink
+	// AllGoroutines captures the stacks of all goroutines instead of only
+	// the one serving the request. Beware, it stops the world longer.
+	AllGoroutines bool
+	// ContextKeys maps names to context keys whose values are added to the
+	// dump.
+	ContextKeys map[string]interface{}
+	// Headers lists the request headers added to the dump. They are copied
+	// for every request, in case the handler modifies them.
+	Headers []string
+	// MinInterval is the minimum time between two dumps, so a stall affecting
+	// all requests does not produce a storm of dumps. Defaults to 10s.
+	MinInterval time.Duration
+}
+
+// SlowHandler returns a handler which, when a request lasts longer than
+// the configured threshold, captures its stack and metadata and hands them
+// to the sink.
+func SlowHandler(o SlowOptions) func(next HandlerC) HandlerC {
+	if o.Sink == nil {
+		panic("xhandler: SlowHandler requires a sink")
+	}
+	if o.Threshold <= 0 {
+		panic("xhandler: SlowHandler requires a positive threshold")
+	}
+	if o.MinInterval == 0 {
+		o.MinInterval = 10 * time.Second
+	}
+	l := &dumpLimiter{interval: o.MinInterval}
+	slots := &slotPool{}
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			// The request may be modified by the handler while the dump is
+			// taken, keep what is reported
+			start := time.Now()
+			method, proto, remoteAddr := r.Method, r.Proto, r.RemoteAddr
+			u := *r.URL
+			var header http.Header
+			if len(o.Headers) > 0 {
+				header = http.Header{}
+				for _, name := range o.Headers {
+					if v := r.Header.Values(name); len(v) > 0 {
+						header[http.CanonicalHeaderKey(name)] = append([]string(nil), v...)
+					}
+				}
+			}
+			// The goroutines serving the request are found in the dump by
+			// their profiler label. Labels are reused once the request and
+			// its dump are done so profiles don't get a value per request.
+			slot := slots.get()
+			id := strconv.Itoa(slot)
+			t := time.AfterFunc(o.Threshold, func() {
+				defer slots.put(slot)
+				suppressed, ok := l.allow()
+				if !ok {
+					return
+				}
+				s := SlowRequest{
+					Method:     method,
+					URL:        u.String(),
+					Proto:      proto,
+					RemoteAddr: remoteAddr,
+					Header:     header,
+					Start:      start,
+					Elapsed:    time.Since(start),
+					Suppressed: suppressed,
+				}
+				if len(o.ContextKeys) > 0 {
+					s.Values = map[string]interface{}{}
+					for name, key := range o.ContextKeys {
+						s.Values[name] = ctx.Value(key)
+					}
+				}
+				if o.AllGoroutines {
+					s.Stack = allStacks()
+				} else {
+					s.Stack = labeledStacks(id)
+				}
+				o.Sink.SlowRequest(ctx, s)
+			})
+			defer func() {
+				if t.Stop() {
+					slots.put(slot)
+				}
+			}()
+			if o.AllGoroutines {
+				next.ServeHTTPC(ctx, w, r)
+				return
+			}
+			pprof.Do(ctx, pprof.Labels(slowLabel, id), func(ctx context.Context) {
+				next.ServeHTTPC(ctx, w, r)
+			})
+		})
+	}
+}
+
+// slotPool hands out the smallest integers not in use.
+type slotPool struct {
+	mu   sync.Mutex
+	free []int
+	next int
+}
+
+func (p *slotPool) get() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.free); n > 0 {
+		slot := p.free[n-1]
+		p.free = p.free[:n-1]
+		return slot
+	}
+	p.next++
+	return p.next
+}
+
+func (p *slotPool) put(slot int) {
+	p.mu.Lock()
+	p.free = append(p.free, slot)
+	p.mu.Unlock()
+}
+
+// dumpLimiter allows one event per interval and counts the dropped ones.
+type dumpLimiter struct {
+	interval   time.Duration
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (l *dumpLimiter) allow() (suppressed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return 0, false
+	}
+	l.last = now
+	suppressed, l.suppressed = l.suppressed, 0
+	return suppressed, true
+}
+
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// slowLabel is the profiler label identifying the goroutines serving a
+// request watched by SlowHandler.
+const slowLabel = "xhandler.slow"
+
+// labeledStacks returns the stacks of the goroutines labeled with the
+// request id from a goroutine profile, or the stacks of all goroutines if
+// none is found.
+func labeledStacks(id string) []byte {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return allStacks()
+	}
+	label := []byte(fmt.Sprintf("%q:%q", slowLabel, id))
+	var stacks [][]byte
+	for _, g := range bytes.Split(buf.Bytes(), []byte("\n\n")) {
+		if bytes.Contains(g, label) {
+			stacks = append(stacks, g)
+		}
+	}
+	if len(stacks) == 0 {
+		return allStacks()
+	}
+	return bytes.Join(stacks, []byte("\n\n"))
+}
@@ -0,0 +1,111 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func slowTestHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestSlowHandler(t *testing.T) {
+	dumps := make(chan SlowRequest, 10)
+	h := SlowHandler(SlowOptions{
+		Threshold:   10 * time.Millisecond,
+		Sink:        SlowSinkFunc(func(ctx context.Context, s SlowRequest) { dumps <- s }),
+		ContextKeys: map[string]interface{}{"test": contextKey},
+		Headers:     []string{"user-agent", "X-Missing"},
+		MinInterval: time.Hour,
+	})(HandlerFuncC(slowTestHandler))
+
+	ctx := context.WithValue(context.Background(), contextKey, "value")
+	r, _ := http.NewRequest("GET", "/slow", nil)
+	r.Header.Set("User-Agent", "test")
+	r.Header.Set("Accept", "text/plain")
+	h.ServeHTTPC(ctx, httptest.NewRecorder(), r)
+	h.ServeHTTPC(ctx, httptest.NewRecorder(), r)
+	h.ServeHTTPC(ctx, httptest.NewRecorder(), r)
+
+	s := <-dumps
+	assert.Equal(t, "GET", s.Method)
+	assert.Equal(t, "/slow", s.URL)
+	assert.Equal(t, http.Header{"User-Agent": {"test"}}, s.Header, "only the listed headers")
+	assert.Equal(t, "value", s.Values["test"])
+	assert.True(t, s.Elapsed >= 10*time.Millisecond)
+	assert.Contains(t, string(s.Stack), "slowTestHandler")
+	assert.NotContains(t, string(s.Stack), "\n\n", "only the request goroutine is captured")
+	assert.Len(t, dumps, 0, "dumps are rate limited")
+}
+
+func TestSlowHandlerRequestChanged(t *testing.T) {
+	dumps := make(chan SlowRequest, 1)
+	h := SlowHandler(SlowOptions{
+		Threshold: time.Millisecond,
+		Sink:      SlowSinkFunc(func(ctx context.Context, s SlowRequest) { dumps <- s }),
+		Headers:   []string{"X-Step"},
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 100; i++ {
+			r.Header.Set("X-Step", "changed")
+			r.URL.Path = "/changed"
+			time.Sleep(100 * time.Microsecond)
+		}
+	}))
+	r, _ := http.NewRequest("GET", "/slow", nil)
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	s := <-dumps
+	assert.Equal(t, "/slow", s.URL)
+	assert.Empty(t, s.Header.Get("X-Step"))
+}
+
+func TestSlowHandlerLabels(t *testing.T) {
+	var labels []string
+	h := SlowHandler(SlowOptions{
+		Threshold: time.Hour,
+		Sink:      SlowSinkFunc(func(ctx context.Context, s SlowRequest) {}),
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		label, _ := pprof.Label(ctx, slowLabel)
+		labels = append(labels, label)
+	}))
+	for i := 0; i < 3; i++ {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	}
+	assert.Equal(t, []string{"1", "1", "1"}, labels, "labels are reused")
+}
+
+func TestSlowHandlerThreshold(t *testing.T) {
+	sink := SlowSinkFunc(func(ctx context.Context, s SlowRequest) {})
+	assert.Panics(t, func() { SlowHandler(SlowOptions{Sink: sink}) })
+	assert.Panics(t, func() { SlowHandler(SlowOptions{Sink: sink, Threshold: -time.Second}) })
+}
+
+func TestSlowHandlerFast(t *testing.T) {
+	called := false
+	h := SlowHandler(SlowOptions{
+		Threshold: time.Second,
+		Sink:      SlowSinkFunc(func(ctx context.Context, s SlowRequest) { called = true }),
+	})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), testRequest)
+	assert.False(t, called)
+}
+
+func TestDumpLimiter(t *testing.T) {
+	l := &dumpLimiter{interval: 20 * time.Millisecond}
+	_, ok := l.allow()
+	assert.True(t, ok)
+	_, ok = l.allow()
+	assert.False(t, ok)
+	_, ok = l.allow()
+	assert.False(t, ok)
+	time.Sleep(25 * time.Millisecond)
+	suppressed, ok := l.allow()
+	assert.True(t, ok)
+	assert.Equal(t, 2, suppressed)
+}
@@ -0,0 +1,435 @@
+package xhandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// TraceID is a W3C Trace Context trace identifier.
+type TraceID [16]byte
+
+// SpanID is a W3C Trace Context span (parent) identifier.
+type SpanID [8]byte
+
+// IsValid tells if the trace ID is not all zeros.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t TraceID) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// IsValid tells if the span ID is not all zeros.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s SpanID) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// FlagSampled is the trace-flags bit telling the caller may have recorded
+// the trace.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// State is the raw, vendor specific tracestate header value.
+	State string
+	// Remote is true when the span context was received from a caller.
+	Remote bool
+}
+
+// IsValid tells if both the trace and span IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Sampled tells if the sampled flag is set.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Traceparent formats the span context as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ErrInvalidTraceparent is returned by ParseTraceparent for malformed values.
+var ErrInvalidTraceparent = errors.New("xhandler: invalid traceparent")
+
+// ParseTraceparent parses a traceparent header value. As required by the
+// spec, versions above 00 are parsed as long as their prefix is valid.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	s = strings.TrimSpace(s)
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	if !isLowerHex(s[0:2]) || s[0:2] == "ff" {
+		return sc, ErrInvalidTraceparent
+	}
+	if s[0:2] == "00" && len(s) != 55 || len(s) > 55 && s[55] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	var flags [1]byte
+	if !isLowerHex(s[3:35]) || !isLowerHex(s[36:52]) || !isLowerHex(s[53:55]) {
+		return sc, ErrInvalidTraceparent
+	}
+	hex.Decode(sc.TraceID[:], []byte(s[3:35]))
+	hex.Decode(sc.SpanID[:], []byte(s[36:52]))
+	hex.Decode(flags[:], []byte(s[53:55]))
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+	sc.Remote = true
+	return sc, nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// SpanStatus is the status code of a finished span.
+type SpanStatus int
+
+const (
+	// StatusUnset is the default status of a span.
+	StatusUnset SpanStatus = iota
+	// StatusOK marks a span as explicitly successful.
+	StatusOK
+	// StatusError marks a span as failed.
+	StatusError
+)
+
+func (s SpanStatus) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusError:
+		return "error"
+	}
+	return "unset"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s SpanStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// SpanData is the immutable record of a finished span handed to exporters.
+type SpanData struct {
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind"`
+	TraceID       TraceID           `json:"trace_id"`
+	SpanID        SpanID            `json:"span_id"`
+	ParentID      SpanID            `json:"parent_id"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+	Status        SpanStatus        `json:"status"`
+	StatusMessage string            `json:"status_message,omitempty"`
+	Errors        []string          `json:"errors,omitempty"`
+}
+
+// Duration returns the span duration.
+func (d SpanData) Duration() time.Duration {
+	return d.End.Sub(d.Start)
+}
+
+// SpanExporter receives spans once they are ended. Implementations must be
+// safe for concurrent use.
+type SpanExporter interface {
+	ExportSpan(SpanData) error
+}
+
+// Span is an in-progress operation of a trace. All methods are safe for
+// concurrent use and a nil *Span is a valid no-op span. Changes made after
+// End are ignored.
+type Span struct {
+	mu       sync.Mutex
+	data     SpanData
+	sc       SpanContext
+	exporter SpanExporter
+	ended    bool
+}
+
+// SpanContext returns the propagated identity of the span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute sets a key/value attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.data.Attributes == nil {
+		s.data.Attributes = map[string]string{}
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetStatus sets the status of the span. An explicit StatusOK is never
+// overridden by a subsequent StatusError.
+func (s *Span) SetStatus(code SpanStatus, msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended || s.data.Status == StatusOK || code == StatusUnset {
+		return
+	}
+	s.data.Status = code
+	s.data.StatusMessage = msg
+}
+
+// RecordError records err on the span and marks it as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.ended {
+		s.data.Errors = append(s.data.Errors, err.Error())
+	}
+	s.mu.Unlock()
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End finishes the span and hands it to the exporter if it was sampled.
+// Calling End more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	d := s.data
+	s.mu.Unlock()
+	if s.exporter != nil && s.sc.Sampled() {
+		s.exporter.ExportSpan(d)
+	}
+}
+
+type spanCtxKey struct{}
+
+// SpanFromContext returns the current span stored in ctx or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan returns a copy of ctx holding s as the current span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanCtxKey{}, s)
+}
+
+// StartSpan starts a child span of the current span in ctx and returns a
+// context holding it. If ctx holds no span, a no-op (nil) span is returned
+// so handlers can be traced unconditionally.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := newSpan(name, "internal", parent.sc, parent.exporter)
+	return ContextWithSpan(ctx, s), s
+}
+
+func newSpan(name, kind string, parent SpanContext, exporter SpanExporter) *Span {
+	sc := SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, State: parent.State}
+	if !sc.TraceID.IsValid() {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+	return &Span{
+		sc:       sc,
+		exporter: exporter,
+		data: SpanData{
+			Name:     name,
+			Kind:     kind,
+			TraceID:  sc.TraceID,
+			SpanID:   sc.SpanID,
+			ParentID: parent.SpanID,
+			Start:    time.Now(),
+		},
+	}
+}
+
+// InjectTraceContext sets the traceparent and tracestate headers of h from
+// the current span in ctx, so the trace continues in the called service.
+func InjectTraceContext(ctx context.Context, h http.Header) {
+	sc := SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		return
+	}
+	h.Set("traceparent", sc.Traceparent())
+	if sc.State != "" {
+		h.Set("tracestate", sc.State)
+	} else {
+		h.Del("tracestate")
+	}
+}
+
+// TraceOptions configures TraceHandler.
+type TraceOptions struct {
+	// Exporter receives the finished spans. Required.
+	Exporter SpanExporter
+	// Name returns the name of the server span. Defaults to "HTTP <method>"
+	// to keep span names low cardinality.
+	Name func(r *http.Request) string
+	// Sample decides if a new trace (one without a valid traceparent) is
+	// sampled. Defaults to sampling all traces. Incoming traces follow the
+	// sampled flag of the caller.
+	Sample func(r *http.Request) bool
+	// ResponseHeader, if set, emits the server span context in a
+	// traceresponse header.
+	ResponseHeader bool
+}
+
+// TraceHandler returns a handler starting a server span for each request,
+// continuing the trace received in the traceparent/tracestate headers if
+// any. The span is stored in the context (see SpanFromContext and
+// StartSpan) and records the response status. 5xx responses mark the span
+// as failed.
+func TraceHandler(o TraceOptions) func(next HandlerC) HandlerC {
+	if o.Exporter == nil {
+		panic("xhandler: TraceHandler requires an exporter")
+	}
+	return func(next HandlerC) HandlerC {
+		return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			parent, err := ParseTraceparent(r.Header.Get("traceparent"))
+			if err == nil {
+				parent.State = strings.TrimSpace(r.Header.Get("tracestate"))
+			} else {
+				parent = SpanContext{}
+				if o.Sample == nil || o.Sample(r) {
+					parent.Flags = FlagSampled
+				}
+			}
+			name := "HTTP " + r.Method
+			if o.Name != nil {
+				name = o.Name(r)
+			}
+			span := newSpan(name, "server", parent, o.Exporter)
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.target", r.URL.RequestURI())
+			if r.Host != "" {
+				span.SetAttribute("http.host", r.Host)
+			}
+			if o.ResponseHeader {
+				w.Header().Set("traceresponse", span.sc.Traceparent())
+			}
+			rw := wrapWriter(w)
+			defer rw.watchPanic(func(p *handlerPanic) {
+				status := rw.Status()
+				if p.failed() {
+					status = http.StatusInternalServerError
+				} else if status == 0 {
+					status = http.StatusOK
+				}
+				span.SetAttribute("http.status_code", fmt.Sprint(status))
+				if status >= 500 {
+					span.SetStatus(StatusError, http.StatusText(status))
+				}
+				span.End()
+			})
+			next.ServeHTTPC(ContextWithSpan(ctx, span), rw, r)
+		})
+	}
+}
+
+// InMemoryExporter stores exported spans in memory. It is mostly useful in
+// tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan implements SpanExporter.
+func (e *InMemoryExporter) ExportSpan(s SpanData) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+	return nil
+}
+
+// Spans returns a copy of the exported spans in export order.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset drops all the stored spans.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
+
+// JSONExporter writes each span as a JSON object on its own line (JSON
+// lines format).
+type JSONExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONExporter creates a JSON lines exporter writing to w, typically a
+// file opened in append mode.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// ExportSpan implements SpanExporter.
+func (e *JSONExporter) ExportSpan(s SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(s)
+}
@@ -0,0 +1,152 @@
+package xhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.True(t, sc.Remote)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	assert.NoError(t, err, "future versions with extra fields are accepted")
+
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(v)
+		assert.Equal(t, ErrInvalidTraceparent, err, v)
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	exp := &InMemoryExporter{}
+	var child SpanContext
+	h := TraceHandler(TraceOptions{Exporter: exp, ResponseHeader: true})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		_, span := StartSpan(ctx, "db")
+		span.SetAttribute("db.system", "sql")
+		span.RecordError(errors.New("no rows"))
+		child = span.SpanContext()
+		span.End()
+		span.End()
+		http.Error(w, "oops", http.StatusBadGateway)
+	}))
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/foo?bar", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "congo=t61rcWkgMzE")
+	h.ServeHTTPC(context.Background(), w, r)
+
+	spans := exp.Spans()
+	if assert.Len(t, spans, 2) {
+		db, srv := spans[0], spans[1]
+		assert.Equal(t, "db", db.Name)
+		assert.Equal(t, "internal", db.Kind)
+		assert.Equal(t, srv.SpanID, db.ParentID)
+		assert.Equal(t, StatusError, db.Status)
+		assert.Equal(t, []string{"no rows"}, db.Errors)
+		assert.Equal(t, "congo=t61rcWkgMzE", child.State)
+
+		assert.Equal(t, "HTTP GET", srv.Name)
+		assert.Equal(t, "server", srv.Kind)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", srv.TraceID.String())
+		assert.Equal(t, "00f067aa0ba902b7", srv.ParentID.String())
+		assert.Equal(t, "/foo?bar", srv.Attributes["http.target"])
+		assert.Equal(t, "502", srv.Attributes["http.status_code"])
+		assert.Equal(t, StatusError, srv.Status)
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+srv.SpanID.String()+"-01", w.Header().Get("traceresponse"))
+	}
+}
+
+func TestTraceHandlerPanic(t *testing.T) {
+	exp := &InMemoryExporter{}
+	h := TraceHandler(TraceOptions{Exporter: exp})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	r, _ := http.NewRequest("GET", "/", nil)
+	assert.PanicsWithValue(t, "boom", func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	})
+	spans := exp.Spans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "500", spans[0].Attributes["http.status_code"])
+		assert.Equal(t, StatusError, spans[0].Status)
+	}
+}
+
+func TestTraceHandlerAbort(t *testing.T) {
+	exp := &InMemoryExporter{}
+	h := TraceHandler(TraceOptions{Exporter: exp})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	r, _ := http.NewRequest("GET", "/", nil)
+	assert.Panics(t, func() {
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	})
+	spans := exp.Spans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "200", spans[0].Attributes["http.status_code"])
+		assert.NotEqual(t, StatusError, spans[0].Status)
+	}
+}
+
+func TestTraceHandlerNotSampled(t *testing.T) {
+	exp := &InMemoryExporter{}
+	h := TraceHandler(TraceOptions{Exporter: exp})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		hdr := http.Header{}
+		InjectTraceContext(ctx, hdr)
+		sc, err := ParseTraceparent(hdr.Get("traceparent"))
+		assert.NoError(t, err)
+		assert.False(t, sc.Sampled())
+	}))
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+	assert.Empty(t, exp.Spans())
+}
+
+func TestStartSpanWithoutTrace(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "noop")
+	assert.Nil(t, span)
+	assert.Equal(t, context.Background(), ctx)
+	span.SetAttribute("a", "b")
+	span.RecordError(errors.New("err"))
+	span.End()
+	hdr := http.Header{}
+	InjectTraceContext(ctx, hdr)
+	assert.Empty(t, hdr)
+}
+
+func TestJSONExporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	exp := NewJSONExporter(buf)
+	exp.ExportSpan(SpanData{Name: "a", TraceID: TraceID{1}, Status: StatusOK})
+	exp.ExportSpan(SpanData{Name: "b"})
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+	var m map[string]interface{}
+	assert.NoError(t, json.Unmarshal(lines[0], &m))
+	assert.Equal(t, "a", m["name"])
+	assert.Equal(t, "01000000000000000000000000000000", m["trace_id"])
+	assert.Equal(t, "ok", m["status"])
+}
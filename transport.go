@@ -0,0 +1,180 @@
+package xhandler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"context"
+)
+
+// RoundTripperFunc is an adapter to allow the use of ordinary functions as
+// http.RoundTripper.
+type RoundTripperFunc func(r *http.Request) (*http.Response, error)
+
+// RoundTrip calls f(r).
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TransportChain is the client side counterpart of Chain: a chain of
+// http.RoundTripper middleware applied to outgoing requests. Middleware get
+// the context of the request with r.Context(), so request contexts must be
+// derived from the server request context for values to be propagated:
+//
+//  c := xhandler.TransportChain{}
+//  c.Use(xhandler.TraceTransport, xhandler.DeadlineTransport(""))
+//  client := c.Client(nil)
+//
+//  // In a handler
+//  req, _ := http.NewRequestWithContext(ctx, "GET", "http://backend/", nil)
+//  res, err := client.Do(req)
+//
+// Like any http.RoundTripper, middleware must not modify the request they
+// are given but a clone of it.
+type TransportChain []func(next http.RoundTripper) http.RoundTripper
+
+// Use appends middleware to the chain.
+func (c *TransportChain) Use(f ...func(next http.RoundTripper) http.RoundTripper) {
+	*c = append(*c, f...)
+}
+
+// With creates a new chain from an existing chain, extending it with
+// additional middleware.
+func (c *TransportChain) With(f ...func(next http.RoundTripper) http.RoundTripper) *TransportChain {
+	n := make(TransportChain, len(*c), len(*c)+len(f))
+	copy(n, *c)
+	n.Use(f...)
+	return &n
+}
+
+// Transport wraps rt with all the middleware of the chain. If rt is nil,
+// http.DefaultTransport is used.
+func (c TransportChain) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	for i := len(c) - 1; i >= 0; i-- {
+		rt = c[i](rt)
+	}
+	return rt
+}
+
+// Client returns a copy of client (or of a zero http.Client if nil) whose
+// transport is wrapped with all the middleware of the chain.
+func (c TransportChain) Client(client *http.Client) *http.Client {
+	n := &http.Client{}
+	if client != nil {
+		*n = *client
+	}
+	n.Transport = c.Transport(n.Transport)
+	return n
+}
+
+// cloneRequest returns a copy of r whose headers can be modified.
+func cloneRequest(r *http.Request) *http.Request {
+	return r.Clone(r.Context())
+}
+
+// TraceTransport starts a client span, child of the span of the request
+// context, for each outgoing request and propagates it with the W3C Trace
+// Context headers. Requests whose context has no span are left untouched.
+func TraceTransport(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		parent := SpanFromContext(r.Context())
+		if parent == nil {
+			return next.RoundTrip(r)
+		}
+		s := newSpan("HTTP "+methodLabel(r.Method), "client", parent.sc, parent.exporter)
+		defer s.End()
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.url", r.URL.String())
+		r = cloneRequest(r)
+		InjectTraceContext(ContextWithSpan(r.Context(), s), r.Header)
+		res, err := next.RoundTrip(r)
+		if err != nil {
+			s.RecordError(err)
+			return res, err
+		}
+		s.SetAttribute("http.status_code", strconv.Itoa(res.StatusCode))
+		if res.StatusCode >= 500 {
+			s.SetStatus(StatusError, http.StatusText(res.StatusCode))
+		}
+		return res, nil
+	})
+}
+
+// DeadlineTransport returns a middleware sending the time remaining before
+// the request context deadline in the header name, in the gRPC timeout format
+// understood by DeadlineHandler. The header defaults to grpc-timeout.
+// Requests whose deadline already passed fail with the context error
+// without being sent.
+func DeadlineTransport(name string) func(next http.RoundTripper) http.RoundTripper {
+	if name == "" {
+		name = "grpc-timeout"
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			deadline, ok := r.Context().Deadline()
+			if !ok {
+				return next.RoundTrip(r)
+			}
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				if r.Body != nil {
+					r.Body.Close()
+				}
+				return nil, context.DeadlineExceeded
+			}
+			r = cloneRequest(r)
+			r.Header.Set(name, FormatGRPCTimeout(remaining))
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// FormatGRPCTimeout formats d in the gRPC timeout format, using the finest
+// unit keeping the value within 8 digits. The value is truncated so the
+// callee never gets more time than d.
+func FormatGRPCTimeout(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	for _, u := range []struct {
+		unit time.Duration
+		name string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+		{time.Hour, "H"},
+	} {
+		if v := d / u.unit; v < 1e8 || u.unit == time.Hour {
+			return strconv.FormatInt(int64(v), 10) + u.name
+		}
+	}
+	panic("unreachable")
+}
+
+// HeaderTransport returns a middleware setting the header name of outgoing
+// requests to the value returned by value for their context, like an ID
+// stored by a server middleware. Empty values and requests already having
+// the header are left untouched.
+func HeaderTransport(name string, value func(ctx context.Context) string) func(next http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Header.Get(name) != "" {
+				return next.RoundTrip(r)
+			}
+			v := value(r.Context())
+			if v == "" {
+				return next.RoundTrip(r)
+			}
+			r = cloneRequest(r)
+			r.Header.Set(name, v)
+			return next.RoundTrip(r)
+		})
+	}
+}
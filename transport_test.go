@@ -0,0 +1,158 @@
+package xhandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordTransport records the last request and answers with status.
+type recordTransport struct {
+	status int
+	err    error
+	last   *http.Request
+}
+
+func (t *recordTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.last = r
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &http.Response{StatusCode: t.status, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+}
+
+func TestTransportChain(t *testing.T) {
+	var order []string
+	mw := func(name string) func(next http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(r)
+			})
+		}
+	}
+	c := TransportChain{}
+	c.Use(mw("a"), mw("b"))
+	c2 := c.With(mw("c"))
+	assert.Len(t, c, 2)
+	assert.Len(t, *c2, 3)
+
+	rt := &recordTransport{status: 200}
+	client := c2.Client(&http.Client{Transport: rt, Timeout: time.Second})
+	assert.Equal(t, time.Second, client.Timeout)
+	res, err := client.Get("http://example.com/")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, order)
+
+	assert.Equal(t, http.DefaultTransport, TransportChain{}.Transport(nil))
+	assert.NotNil(t, c.Client(nil).Transport)
+}
+
+func TestTraceTransport(t *testing.T) {
+	exp := &InMemoryExporter{}
+	rt := &recordTransport{status: 503}
+	var client *http.Client
+	h := TraceHandler(TraceOptions{Exporter: exp})(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequest("GET", "http://backend/users", nil)
+		req = req.WithContext(ctx)
+		res, err := client.Do(req)
+		if assert.NoError(t, err) {
+			res.Body.Close()
+		}
+		assert.Empty(t, req.Header.Get("traceparent"), "the original request must not be modified")
+	}))
+	client = TransportChain{TraceTransport}.Client(&http.Client{Transport: rt})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTPC(context.Background(), httptest.NewRecorder(), r)
+
+	spans := exp.Spans()
+	if assert.Len(t, spans, 2) {
+		client, server := spans[0], spans[1]
+		assert.Equal(t, "client", client.Kind)
+		assert.Equal(t, "HTTP GET", client.Name)
+		assert.Equal(t, server.SpanID, client.ParentID)
+		assert.Equal(t, StatusError, client.Status)
+		assert.Equal(t, "503", client.Attributes["http.status_code"])
+		sc, err := ParseTraceparent(rt.last.Header.Get("traceparent"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, client.TraceID, sc.TraceID)
+			assert.Equal(t, client.SpanID, sc.SpanID)
+		}
+	}
+
+	// No span in context
+	req, _ := http.NewRequest("GET", "http://backend/", nil)
+	rt.err = errors.New("refused")
+	_, err := client.Do(req)
+	assert.Error(t, err)
+	assert.Empty(t, rt.last.Header.Get("traceparent"))
+}
+
+func TestDeadlineTransport(t *testing.T) {
+	rt := &recordTransport{status: 200}
+	client := TransportChain{DeadlineTransport("")}.Client(&http.Client{Transport: rt})
+
+	req, _ := http.NewRequest("GET", "http://backend/", nil)
+	client.Do(req)
+	assert.Empty(t, rt.last.Header.Get("grpc-timeout"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client.Do(req.WithContext(ctx))
+	d, err := ParseDeadline(rt.last.Header.Get("grpc-timeout"), time.Now())
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, time.Now().Add(2*time.Second), d, 50*time.Millisecond)
+	}
+
+	rt.last = nil
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = client.Do(req.WithContext(ctx))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Nil(t, rt.last)
+}
+
+func TestFormatGRPCTimeout(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		-time.Second:               "0n",
+		1500 * time.Microsecond:    "1500000n",
+		99999999 * time.Nanosecond: "99999999n",
+		100 * time.Millisecond:     "100000u",
+		2*time.Second + 1:          "2000000u",
+		30 * time.Second:           "30000000u",
+		48 * time.Hour:             "172800S",
+		24 * 365 * 10 * time.Hour:  "5256000M",
+		1<<63 - 1:                  "2562047H",
+	} {
+		assert.Equal(t, want, FormatGRPCTimeout(d), d.String())
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	rt := &recordTransport{status: 200}
+	client := TransportChain{HeaderTransport("X-Tenant", func(ctx context.Context) string {
+		v, _ := ctx.Value(contextKey).(string)
+		return v
+	})}.Client(&http.Client{Transport: rt})
+
+	req, _ := http.NewRequest("GET", "http://backend/", nil)
+	client.Do(req.WithContext(context.WithValue(context.Background(), contextKey, "acme")))
+	assert.Equal(t, "acme", rt.last.Header.Get("X-Tenant"))
+	assert.Empty(t, req.Header.Get("X-Tenant"))
+
+	client.Do(req)
+	assert.Empty(t, rt.last.Header.Get("X-Tenant"))
+
+	req.Header.Set("X-Tenant", "explicit")
+	client.Do(req.WithContext(context.WithValue(context.Background(), contextKey, "acme")))
+	assert.Equal(t, "explicit", rt.last.Header.Get("X-Tenant"))
+}
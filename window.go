@@ -0,0 +1,241 @@
+package xhandler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"context"
+)
+
+// RateLimitPolicy is a quota of requests per time window, like 10 per second
+// or 10000 per day.
+type RateLimitPolicy struct {
+	// Name identifies the policy in the RateLimit headers. Defaults to the
+	// window, e.g. "1s".
+	Name   string
+	Quota  int
+	Window time.Duration
+}
+
+// Quota is the state of a policy for a key.
+type Quota struct {
+	Policy RateLimitPolicy
+	// Remaining is the number of requests left in the window.
+	Remaining int
+	// Reset is the time until the current window ends, or if the quota is
+	// exhausted, until a request is allowed again.
+	Reset time.Duration
+}
+
+type quotaCtxKey struct{}
+
+// QuotaFromContext returns the quotas of the current request key, after the
+// request was counted, as stored by SlidingWindowLimiter.Handler.
+func QuotaFromContext(ctx context.Context) []Quota {
+	q, _ := ctx.Value(quotaCtxKey{}).([]Quota)
+	return q
+}
+
+// SlidingWindowOptions configures a SlidingWindowLimiter.
+type SlidingWindowOptions struct {
+	// Policies are enforced simultaneously: a request is allowed only if
+	// all of them have quota left.
+	Policies []RateLimitPolicy
+	// Key returns the key requests are limited by. Requests with an empty
+	// key are not limited. If nil, all requests share the same quotas.
+	Key func(ctx context.Context, r *http.Request) string
+}
+
+// SlidingWindowLimiter limits requests per key with the sliding window
+// counter algorithm: the count of the previous fixed window is weighted by
+// its overlap with the sliding window, which smooths the bursts allowed at
+// fixed window boundaries with a constant memory per key.
+type SlidingWindowLimiter struct {
+	policies []RateLimitPolicy
+	key      func(ctx context.Context, r *http.Request) string
+	shards   [32]windowShard
+	maxWin   time.Duration
+}
+
+type windowShard struct {
+	mu        sync.Mutex
+	keys      map[string][]windowCounter
+	lastSweep time.Time
+}
+
+type windowCounter struct {
+	start      time.Time
+	prev, curr int
+}
+
+// NewSlidingWindowLimiter creates a sliding window limiter.
+func NewSlidingWindowLimiter(o SlidingWindowOptions) *SlidingWindowLimiter {
+	if len(o.Policies) == 0 {
+		panic("xhandler: sliding window limiter needs a policy")
+	}
+	l := &SlidingWindowLimiter{key: o.Key}
+	for _, p := range o.Policies {
+		if p.Window <= 0 || p.Quota < 0 {
+			panic("xhandler: invalid rate limit policy")
+		}
+		if p.Name == "" {
+			p.Name = p.Window.String()
+		}
+		if p.Window > l.maxWin {
+			l.maxWin = p.Window
+		}
+		l.policies = append(l.policies, p)
+	}
+	for i := range l.shards {
+		l.shards[i].keys = map[string][]windowCounter{}
+	}
+	return l
+}
+
+// Allow counts a request for key at now if all policies have quota left.
+// It returns the quotas of all policies.
+func (l *SlidingWindowLimiter) Allow(key string, now time.Time) (bool, []Quota) {
+	sh := l.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if now.Sub(sh.lastSweep) >= l.maxWin {
+		for k, counters := range sh.keys {
+			if expired(counters, l.policies, now) {
+				delete(sh.keys, k)
+			}
+		}
+		sh.lastSweep = now
+	}
+	counters, found := sh.keys[key]
+	if !found {
+		counters = make([]windowCounter, len(l.policies))
+		sh.keys[key] = counters
+	}
+	allowed := true
+	for i, p := range l.policies {
+		counters[i].slide(p.Window, now)
+		if counters[i].estimate(p.Window, now)+1 > float64(p.Quota) {
+			allowed = false
+		}
+	}
+	quotas := make([]Quota, len(l.policies))
+	for i, p := range l.policies {
+		c := &counters[i]
+		if allowed {
+			c.curr++
+		}
+		remaining := int(math.Floor(float64(p.Quota) - c.estimate(p.Window, now)))
+		if remaining < 0 {
+			remaining = 0
+		}
+		reset := c.start.Add(p.Window).Sub(now)
+		if remaining == 0 {
+			reset = c.wait(p, now)
+		}
+		quotas[i] = Quota{Policy: p, Remaining: remaining, Reset: reset}
+	}
+	return allowed, quotas
+}
+
+func (l *SlidingWindowLimiter) shard(key string) *windowShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l.shards[h.Sum32()%uint32(len(l.shards))]
+}
+
+// expired tells if all the counters only hold requests out of their
+// sliding window.
+func expired(counters []windowCounter, policies []RateLimitPolicy, now time.Time) bool {
+	for i, p := range policies {
+		if now.Sub(counters[i].start) < 2*p.Window {
+			return false
+		}
+	}
+	return true
+}
+
+// slide moves c to the fixed window containing now.
+func (c *windowCounter) slide(window time.Duration, now time.Time) {
+	start := now.Truncate(window)
+	switch {
+	case start.Equal(c.start):
+	case start.Sub(c.start) == window:
+		c.start, c.prev, c.curr = start, c.curr, 0
+	default:
+		c.start, c.prev, c.curr = start, 0, 0
+	}
+}
+
+// estimate returns the number of requests in the sliding window ending at
+// now.
+func (c *windowCounter) estimate(window time.Duration, now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(c.start))/float64(window)
+	return float64(c.prev)*overlap + float64(c.curr)
+}
+
+// wait returns the time until the estimate leaves room for a request.
+func (c *windowCounter) wait(p RateLimitPolicy, now time.Time) time.Duration {
+	if p.Quota == 0 {
+		return c.start.Add(p.Window).Sub(now)
+	}
+	window := float64(p.Window)
+	elapsed := float64(now.Sub(c.start))
+	room := float64(p.Quota - 1)
+	// Within the current window, as the previous one fades out
+	if free := room - float64(c.curr); free >= 0 && c.prev > 0 {
+		if x := window*(1-free/float64(c.prev)) - elapsed; x < window-elapsed {
+			return time.Duration(math.Ceil(math.Max(0, x)))
+		}
+	}
+	// In the next window, as the current one fades out
+	y := 0.0
+	if c.curr > 0 {
+		y = math.Max(0, window*(1-room/float64(c.curr)))
+	}
+	return time.Duration(math.Ceil(window - elapsed + y))
+}
+
+// Handler implements the middleware. The RateLimit-Policy and RateLimit
+// headers are set on every response (see the IETF RateLimit header fields
+// draft) and the quotas stored in the context. Requests over quota get a 429
+// Too Many Requests response with a Retry-After header.
+func (l *SlidingWindowLimiter) Handler(next HandlerC) HandlerC {
+	return HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		key := ""
+		if l.key != nil {
+			if key = l.key(ctx, r); key == "" {
+				next.ServeHTTPC(ctx, w, r)
+				return
+			}
+		}
+		allowed, quotas := l.Allow(key, time.Now())
+		policies := make([]string, len(quotas))
+		states := make([]string, len(quotas))
+		var wait time.Duration
+		for i, q := range quotas {
+			policies[i] = fmt.Sprintf("%q;q=%d;w=%d", q.Policy.Name, q.Policy.Quota, seconds(q.Policy.Window))
+			states[i] = fmt.Sprintf("%q;r=%d;t=%d", q.Policy.Name, q.Remaining, seconds(q.Reset))
+			if q.Remaining == 0 && q.Reset > wait {
+				wait = q.Reset
+			}
+		}
+		w.Header().Set("RateLimit-Policy", strings.Join(policies, ", "))
+		w.Header().Set("RateLimit", strings.Join(states, ", "))
+		if !allowed {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTPC(context.WithValue(ctx, quotaCtxKey{}, quotas), w, r)
+	})
+}
+
+// seconds returns d in seconds, rounded up.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,143 @@
+package xhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var windowEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestSlidingWindowLimiter(t *testing.T) {
+	l := NewSlidingWindowLimiter(SlidingWindowOptions{
+		Policies: []RateLimitPolicy{{Quota: 10, Window: time.Second}},
+	})
+	for i := 0; i < 10; i++ {
+		allowed, q := l.Allow("k", windowEpoch)
+		assert.True(t, allowed, "request %d", i)
+		assert.Equal(t, 9-i, q[0].Remaining)
+	}
+	allowed, q := l.Allow("k", windowEpoch.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+	assert.Equal(t, "1s", q[0].Policy.Name)
+	assert.Equal(t, 0, q[0].Remaining)
+	// The previous window must fade to 90% for a request to fit
+	assert.Equal(t, 600*time.Millisecond, q[0].Reset)
+
+	allowed, _ = l.Allow("k", windowEpoch.Add(1099*time.Millisecond))
+	assert.False(t, allowed)
+	allowed, q = l.Allow("k", windowEpoch.Add(1100*time.Millisecond))
+	assert.True(t, allowed)
+	assert.Equal(t, 0, q[0].Remaining)
+
+	// Half way in the next window, half of the previous count remains
+	n := 0
+	for {
+		if allowed, _ := l.Allow("k", windowEpoch.Add(1500*time.Millisecond)); !allowed {
+			break
+		}
+		n++
+	}
+	assert.Equal(t, 4, n)
+
+	allowed, q = l.Allow("other", windowEpoch.Add(1500*time.Millisecond))
+	assert.True(t, allowed)
+	assert.Equal(t, 9, q[0].Remaining)
+	assert.Equal(t, 500*time.Millisecond, q[0].Reset)
+}
+
+func TestSlidingWindowLimiterPolicies(t *testing.T) {
+	l := NewSlidingWindowLimiter(SlidingWindowOptions{
+		Policies: []RateLimitPolicy{
+			{Name: "burst", Quota: 2, Window: time.Second},
+			{Name: "daily", Quota: 3, Window: 24 * time.Hour},
+		},
+	})
+	allowed, _ := l.Allow("k", windowEpoch)
+	assert.True(t, allowed)
+	allowed, q := l.Allow("k", windowEpoch)
+	assert.True(t, allowed)
+	assert.Equal(t, 0, q[0].Remaining)
+	assert.Equal(t, 1, q[1].Remaining)
+	// Denied requests are not counted by the other policies
+	allowed, q = l.Allow("k", windowEpoch)
+	assert.False(t, allowed)
+	assert.Equal(t, 1, q[1].Remaining)
+
+	allowed, q = l.Allow("k", windowEpoch.Add(5*time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, 1, q[0].Remaining)
+	assert.Equal(t, 0, q[1].Remaining)
+	assert.Equal(t, 32*time.Hour-5*time.Second, q[1].Reset)
+	allowed, _ = l.Allow("k", windowEpoch.Add(10*time.Second))
+	assert.False(t, allowed)
+}
+
+func TestSlidingWindowLimiterEviction(t *testing.T) {
+	l := NewSlidingWindowLimiter(SlidingWindowOptions{
+		Policies: []RateLimitPolicy{{Quota: 1, Window: time.Second}},
+	})
+	// Find keys sharing a shard
+	sh := l.shard("a")
+	keys := []string{"a"}
+	for i := 0; len(keys) < 3; i++ {
+		if k := strconv.Itoa(i); l.shard(k) == sh {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		l.Allow(k, windowEpoch)
+	}
+	assert.Len(t, sh.keys, 3)
+	l.Allow("a", windowEpoch.Add(1500*time.Millisecond))
+	assert.Len(t, sh.keys, 3)
+	l.Allow("a", windowEpoch.Add(5*time.Second))
+	assert.Len(t, sh.keys, 1)
+}
+
+func TestSlidingWindowLimiterHandler(t *testing.T) {
+	l := NewSlidingWindowLimiter(SlidingWindowOptions{
+		Policies: []RateLimitPolicy{
+			{Name: "burst", Quota: 2, Window: time.Minute},
+			{Name: "daily", Quota: 1000, Window: 24 * time.Hour},
+		},
+		Key: KeyByHeader("X-Api-Key"),
+	})
+	var quotas []Quota
+	h := l.Handler(HandlerFuncC(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		quotas = QuotaFromContext(ctx)
+	}))
+	serve := func(apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Api-Key", apiKey)
+		h.ServeHTTPC(context.Background(), w, r)
+		return w
+	}
+	w := serve("a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"burst";q=2;w=60, "daily";q=1000;w=86400`, w.Header().Get("RateLimit-Policy"))
+	assert.Regexp(t, `^"burst";r=1;t=\d+, "daily";r=999;t=\d+$`, w.Header().Get("RateLimit"))
+	if assert.Len(t, quotas, 2) {
+		assert.Equal(t, 1, quotas[0].Remaining)
+		assert.Equal(t, 999, quotas[1].Remaining)
+	}
+
+	serve("a")
+	quotas = nil
+	w = serve("a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Regexp(t, `^"burst";r=0;t=\d+, "daily";r=998;t=\d+$`, w.Header().Get("RateLimit"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Nil(t, quotas)
+
+	w = serve("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit"))
+}